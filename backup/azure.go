@@ -0,0 +1,330 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"io"
+	"monodb-backup/config"
+	"monodb-backup/notify"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+)
+
+// maxBlockSize is the largest block Azure accepts in a block blob
+const maxBlockSize = 4000 * 1024 * 1024
+
+type azureStruct struct {
+	instance  config.BackupTypeInfo
+	container *container.Client
+	tier      *blob.AccessTier
+	blockSize int64
+	throttle  *throttle
+}
+
+var azureTargets []azureStruct
+
+func InitializeAzure() {
+	if len(azureTargets) > 0 {
+		return
+	}
+	for _, info := range params.BackupType.Info {
+		client, err := newAzureClient(info)
+		if err != nil {
+			logger.Fatal("Couldn't initialize Azure Blob client for container " + info.Bucket + ": " + err.Error())
+			return
+		}
+		throttle, err := newThrottle(info.Bandwidth)
+		if err != nil {
+			logger.Fatal("Invalid bandwidth settings for container " + info.Bucket + ": " + err.Error())
+			return
+		}
+		var tier *blob.AccessTier
+		if info.AccessTier != "" {
+			tier = to.Ptr(blob.AccessTier(info.AccessTier))
+		}
+		blockSize := params.PartSize * 1024 * 1024
+		if info.PartSize > 0 {
+			blockSize = info.PartSize * 1024 * 1024
+		}
+		azureTargets = append(azureTargets, azureStruct{
+			instance:  info,
+			container: client.ServiceClient().NewContainerClient(info.Bucket),
+			tier:      tier,
+			blockSize: blockSize,
+			throttle:  throttle,
+		})
+	}
+}
+
+// newAzureClient authenticates with a connection string, a SAS token or the
+// storage account's shared key, in that order
+func newAzureClient(info config.BackupTypeInfo) (*azblob.Client, error) {
+	switch {
+	case info.ConnectionString != "":
+		return azblob.NewClientFromConnectionString(info.ConnectionString, nil)
+	case info.SASToken != "":
+		return azblob.NewClientWithNoCredential(azureServiceURL(info)+"?"+strings.TrimPrefix(info.SASToken, "?"), nil)
+	default:
+		cred, err := azblob.NewSharedKeyCredential(info.AccessKey, info.SecretKey)
+		if err != nil {
+			return nil, err
+		}
+		return azblob.NewClientWithSharedKeyCredential(azureServiceURL(info), cred, nil)
+	}
+}
+
+// azureServiceURL is the endpoint if given, e.g. Azurite's
+// http://127.0.0.1:10000/devstoreaccount1, or the account's public endpoint
+func azureServiceURL(info config.BackupTypeInfo) string {
+	if info.Endpoint != "" {
+		return strings.TrimSuffix(info.Endpoint, "/") + "/"
+	}
+	return "https://" + info.AccessKey + ".blob.core.windows.net/"
+}
+
+func azureTargetID(target *azureStruct) string {
+	return azureServiceURL(target.instance) + target.instance.Bucket
+}
+
+func azureMetadata(m *manifest, key string) map[string]*string {
+	if m == nil {
+		return nil
+	}
+	metadata := make(map[string]*string)
+	for k, v := range objectFieldValues(m, key) {
+		metadata[k] = to.Ptr(v)
+	}
+	return metadata
+}
+
+func (target *azureStruct) concurrency() int {
+	if target.instance.Concurrency > 0 {
+		return target.instance.Concurrency
+	}
+	return 10
+}
+
+// uploadFileToAzure uploads a dump from src, or from reader while it is being
+// dumped, then handles its sidecars, rotation and retention like the other
+// destinations do.
+func uploadFileToAzure(ctx context.Context, src, dst, db string, reader io.Reader, target *azureStruct, m *manifest, blockSize int64) error {
+	containerName := target.instance.Bucket
+	if reader == nil {
+		file, err := os.Open(src)
+		if err != nil {
+			logger.Error("Couldn't open file " + src + " to read - Error: " + err.Error())
+			return err
+		}
+		defer file.Close()
+		reader = file
+	} else {
+		src = db
+	}
+	if blockSize > maxBlockSize {
+		blockSize = maxBlockSize
+	}
+
+	// a streamed dump's checksum is only known once it has been uploaded
+	checksumKnown := m != nil && m.SHA256 != ""
+	blobClient := target.container.NewBlockBlobClient(dst)
+	_, err := blobClient.UploadStream(ctx, target.throttle.reader(reader), &blockblob.UploadStreamOptions{
+		BlockSize:   blockSize,
+		Concurrency: target.concurrency(),
+		Metadata:    azureMetadata(m, dst),
+		AccessTier:  target.tier,
+		Tags:        tagMap(m, dst),
+	})
+	if err != nil {
+		logger.Error("Couldn't upload " + src + " to Azure\nContainer: " + containerName + " path: " + dst + "\n Error: " + err.Error())
+		return err
+	}
+	if !checksumKnown && m != nil {
+		if _, err := blobClient.SetMetadata(ctx, azureMetadata(m, dst), nil); err != nil {
+			logger.Error("Couldn't set metadata of " + dst + " on Azure\nContainer: " + containerName + "\n Error: " + err.Error())
+			return err
+		}
+		if tags := tagMap(m, dst); tags != nil {
+			if _, err := blobClient.SetTags(ctx, tags, nil); err != nil {
+				logger.Error("Couldn't tag " + dst + " on Azure\nContainer: " + containerName + "\n Error: " + err.Error())
+				return err
+			}
+		}
+	}
+	if err := verifyAzureUpload(ctx, blobClient, dst, m); err != nil {
+		logger.Error("Couldn't verify " + src + " on Azure\nContainer: " + containerName + " path: " + dst + "\n Error: " + err.Error())
+		return err
+	}
+	logger.Info("Successfully uploaded " + src + " to Azure\nContainer: " + containerName + " path: " + dst)
+
+	if err := putSidecarsToAzure(ctx, target, dst, m); err != nil {
+		return err
+	}
+
+	if params.Rotation.Enabled {
+		if db == "mysql" {
+			db = db + "_users"
+		}
+		targetID := azureTargetID(target)
+		shouldRotate, name := rotate(db, targetID)
+		if shouldRotate {
+			if target.instance.Path != "" {
+				name = target.instance.Path + "/" + name
+			}
+			extension := strings.Split(dst, ".")
+			for i := 1; i < len(extension); i++ {
+				name = name + "." + extension[i]
+			}
+			if err := copyAzureBlob(ctx, target, blobClient, name, m); err != nil {
+				logger.Error("Couldn't create copy of " + src + " for rotation\nContainer: " + containerName + " path: " + name + "\n Error: " + err.Error())
+				return err
+			}
+			if err := putSidecarsToAzure(ctx, target, name, m); err != nil {
+				return err
+			}
+			updateRotatedTimestamp(db, targetID)
+			logger.Info("Successfully created a copy of " + src + " for rotation\nContainer: " + containerName + " path: " + name)
+		}
+
+		if retentionEnabled() {
+			if err := cleanupAzure(ctx, target); err != nil {
+				logger.Error("Error during Azure cleanup: " + err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// verifyAzureUpload compares the stored blob's size with what was hashed
+// during the upload, every block is checked by Azure while receiving it
+func verifyAzureUpload(ctx context.Context, blobClient *blockblob.Client, dst string, m *manifest) error {
+	if m == nil || m.SHA256 == "" {
+		return nil
+	}
+	props, err := blobClient.GetProperties(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if props.ContentLength != nil && *props.ContentLength != m.Size {
+		return errors.New("size mismatch for " + dst + " - expected: " + strconv.FormatInt(m.Size, 10) + " got: " + strconv.FormatInt(*props.ContentLength, 10))
+	}
+	return nil
+}
+
+func putSidecarsToAzure(ctx context.Context, target *azureStruct, dst string, m *manifest) error {
+	for _, sc := range m.sidecars(dst) {
+		_, err := target.container.NewBlockBlobClient(dst+sc.suffix).UploadBuffer(ctx, sc.data, &blockblob.UploadBufferOptions{
+			AccessTier: target.tier,
+			Tags:       tagMap(m, dst),
+		})
+		if err != nil {
+			logger.Error("Couldn't upload " + dst + sc.suffix + " to Azure\nContainer: " + target.instance.Bucket + "\n Error: " + err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// copyAzureBlob creates a rotation copy inside the storage account and waits
+// for Azure to finish it
+func copyAzureBlob(ctx context.Context, target *azureStruct, src *blockblob.Client, dst string, m *manifest) error {
+	dstClient := target.container.NewBlockBlobClient(dst)
+	resp, err := dstClient.StartCopyFromURL(ctx, src.URL(), &blob.StartCopyFromURLOptions{
+		Metadata: azureMetadata(m, dst),
+		BlobTags: tagMap(m, dst),
+		Tier:     target.tier,
+	})
+	if err != nil {
+		return err
+	}
+	status := resp.CopyStatus
+	for status != nil && *status == blob.CopyStatusTypePending {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
+		props, err := dstClient.GetProperties(ctx, nil)
+		if err != nil {
+			return err
+		}
+		status = props.CopyStatus
+	}
+	if status != nil && *status != blob.CopyStatusTypeSuccess {
+		return errors.New("copy finished with status " + string(*status))
+	}
+	return nil
+}
+
+func cleanupAzure(ctx context.Context, target *azureStruct) error {
+	list := func(dir string) ([]BackupFile, error) {
+		prefix := dir + "/"
+		if target.instance.Path != "" {
+			prefix = target.instance.Path + "/" + prefix
+		}
+		var backups []BackupFile
+		pager := target.container.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{Prefix: to.Ptr(prefix)})
+		for pager.More() {
+			page, err := pager.NextPage(ctx)
+			if err != nil {
+				return nil, err
+			}
+			for _, item := range page.Segment.BlobItems {
+				if item.Name == nil || item.Properties == nil || item.Properties.LastModified == nil {
+					continue
+				}
+				backups = append(backups, BackupFile{Name: *item.Name, Time: *item.Properties.LastModified, Path: *item.Name})
+			}
+		}
+		return backups, nil
+	}
+	remove := func(f BackupFile) error {
+		_, err := target.container.NewBlobClient(f.Path).Delete(ctx, nil)
+		return err
+	}
+	return applyRetention(list, remove)
+}
+
+func uploadToAzure(src, dst, db string, m *manifest) {
+	ctx := context.Background()
+	for i := range azureTargets {
+		target := &azureTargets[i]
+		finalDst := nameWithPath(dst)
+		if target.instance.Path != "" {
+			finalDst = target.instance.Path + "/" + finalDst
+		}
+		err := uploadFileToAzure(ctx, src, finalDst, db, nil, target, m, target.blockSize)
+		if err != nil {
+			notify.FailedDBList = append(notify.FailedDBList, db+" - "+src+" - "+err.Error())
+			FailedDBNames = append(FailedDBNames, db)
+		} else {
+			notify.SuccessfulDBList = append(notify.SuccessfulDBList, db+" - "+src)
+		}
+	}
+}
+
+func azureStreamTargets(db, name string, m *manifest, estimate int64) []streamTarget {
+	var targets []streamTarget
+	for i := range azureTargets {
+		target := &azureTargets[i]
+		dst := name
+		if target.instance.Path != "" {
+			dst = target.instance.Path + "/" + name
+		}
+		blockSize := streamPartSize(target.blockSize, estimate)
+		targets = append(targets, streamTarget{
+			name: azureTargetID(target),
+			upload: func(ctx context.Context, r io.Reader) error {
+				return uploadFileToAzure(ctx, "", dst, db, r, target, m, blockSize)
+			},
+		})
+	}
+	return targets
+}
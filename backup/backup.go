@@ -2,12 +2,12 @@ package backup
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"monodb-backup/notify"
 	"os"
 	"path/filepath"
-	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
@@ -71,14 +71,14 @@ func getDBList() []string {
 	}
 }
 
-func dumpAndUpload(db string, pipeWriters []*io.PipeWriter) error {
+func dumpAndUpload(db string, w io.Writer) error {
 	switch params.Database {
 	case "postgresql":
-		return dumpAndUploadPSQL(db, pipeWriters)
+		return dumpAndUploadPSQL(db, w)
 	case "mysql":
-		return dumpAndUploadMySQL(db, pipeWriters)
+		return dumpAndUploadMySQL(db, w)
 	default:
-		return dumpAndUploadPSQL(db, pipeWriters)
+		return dumpAndUploadPSQL(db, w)
 	}
 }
 
@@ -103,7 +103,7 @@ func Backup() {
 	currentDB = ""
 	mu.Unlock()
 
-	streamable := (params.Database == "" || params.Database == "postgresql" || (params.Database == "mysql" && !params.BackupAsTables)) && params.ArchivePass == ""
+	streamable := (params.Database == "" || params.Database == "postgresql" || (params.Database == "mysql" && !params.BackupAsTables))
 
 	dateNow = rightNow{
 		day:    time.Now().Format("Mon"),
@@ -133,17 +133,34 @@ func Backup() {
 		params.Databases = tmpDatabases
 	}
 
-	if streamable && (params.BackupType.Type == "minio" || params.BackupType.Type == "s3") {
+	if !Retrying {
+		params.Databases = psqlDatabases(params.Databases)
+	}
+
+	if (params.BackupType.Type == "minio" || params.BackupType.Type == "s3") && !Retrying {
+		abortStaleS3Uploads()
+	}
+
+	if streamable && streamingBackend() {
 		for _, db := range params.Databases {
 			mu.Lock()
 			currentDB = db
 			currentDBStartTime = time.Now()
 			mu.Unlock()
+			// uploads that failed from the spool in an earlier run are
+			// finished first, like those of local dumps
+			if resumePendingUploads(db) && Retrying {
+				logger.Info("Resumed the uploads of " + db + " instead of dumping it again")
+				continue
+			}
 			uploadWhileDumping(db)
 		}
 		mu.Lock()
 		currentDB = ""
 		mu.Unlock()
+		if pgPhysical() {
+			CleanupWAL()
+		}
 		logger.Info("monodb-backup streamable job finished.")
 		return
 	}
@@ -163,7 +180,12 @@ func Backup() {
 		for i := 1; i < len(fullPath)-1; i++ {
 			dst = dst + "/" + fullPath[i]
 		}
-		if params.BackupAsTables && db != "mysql" {
+		// uploads interrupted in an earlier run are finished first. When
+		// retrying, the dump they were sending is the one this run made.
+		resumed := resumePendingUploads(db)
+		if resumed && Retrying {
+			logger.Info("Resumed the uploads of " + db + " instead of dumping it again")
+		} else if params.BackupAsTables && db != "mysql" {
 			dumpPaths, names, err := dumpDBWithTables(db, dst)
 			if err != nil {
 				// notify.SendAlarm("Problem during backing up "+db+" - Error: "+err.Error(), true)
@@ -173,7 +195,11 @@ func Backup() {
 				// notify.SendAlarm("Successfully backed up "+db+" at "+params.BackupDestination+"/"+db, false)
 				for i, filePath := range dumpPaths {
 					name := names[i]
-					upload(name, db, filePath)
+					var m *manifest
+					if !strings.HasSuffix(name, ".meta") {
+						m = newManifest(db, name)
+					}
+					upload(name, db, filePath, m)
 				}
 			}
 
@@ -189,10 +215,12 @@ func Backup() {
 				// notify.SendAlarm("Successfully backed up "+db+" at "+filePath, false)
 				notify.SuccessfulDBList = append(notify.SuccessfulDBList, db)
 
-				upload(name, db, filePath)
+				upload(name, db, filePath, newManifest(db, name))
 			}
 		}
-		if params.RemoveLocal {
+		if params.RemoveLocal && len(pendingUploads(db)) > 0 {
+			logger.Info("Keeping the dump of " + db + " at " + dst + " to resume its unfinished uploads")
+		} else if params.RemoveLocal {
 			err := os.RemoveAll(dst)
 			if err != nil {
 				logger.Error("Couldn't delete dump file at " + params.BackupDestination + "/" + db + " - Error: " + err.Error())
@@ -213,6 +241,9 @@ func Backup() {
 	if params.Database == "mssql" {
 		mssqlDB.Close()
 	}
+	if pgPhysical() {
+		CleanupWAL()
+	}
 	logger.Info("monodb-backup non-streamable job finished.")
 }
 
@@ -228,71 +259,133 @@ func uploadWhileDumping(db string) {
 	}
 	switch params.Database {
 	case "postgresql":
-		name = name + ".dump"
+		name = name + pgDumpExtension(db) + artifactExtension()
 	case "mysql":
-		name = name + ".sql.gz"
+		name = name + ".sql" + artifactExtension()
 	default:
-		name = name + ".dump"
-	}
-	var pipeWriters []*io.PipeWriter
-	var uploadDone []chan error
-	for i, instance := range uploaders {
-		dumpPath := instance.instance.Path + "/" + name
-		pipeReader, pipeWriter := io.Pipe()
-		pipeWriters = append(pipeWriters, pipeWriter)
-		uploadDone = append(uploadDone, make(chan error))
-		go func(i int, instance uploaderStruct) {
-
-			err := uploadFileToS3(ctx, "", dumpPath, db, pipeReader, &instance)
-			pipeWriter.Close()
-			uploadDone[i] <- err
-			close(uploadDone[i])
-		}(i, instance)
+		name = name + pgDumpExtension(db) + artifactExtension()
 	}
+	m := newManifest(db, name)
+	// the dump's length isn't known while it streams, the part size is picked
+	// from the database's size so that it fits in S3's part limit
+	estimate := estimateDumpSize(db)
+	targets := streamTargets(db, name, m, estimate)
 
-	err := dumpAndUpload(db, pipeWriters)
+	fan, err := newFanOut(ctx, db, name, targets)
 	if err != nil {
-		logger.Error("Error during dump of " + db + " - Error: " + err.Error())
-		for _, writer := range pipeWriters {
-			writer.Close()
+		logger.Error("Couldn't start the upload of " + db + " - Error: " + err.Error())
+		notify.FailedDBList = append(notify.FailedDBList, db+" - Error: "+err.Error())
+		FailedDBNames = append(FailedDBNames, db)
+		return
+	}
+	checksum := newChecksumWriter()
+	err = dumpAndUpload(db, io.MultiWriter(fan, checksum))
+	if err == nil {
+		m.SHA256 = checksum.sum()
+		m.Size = checksum.size
+		if db == pgBaseBackup {
+			m.WALStart = baseBackupWALStart
 		}
+	}
+	// a failed dump aborts the uploads instead of completing them with a
+	// truncated dump
+	results := fan.finish(err)
+	if err != nil {
+		logger.Error("Error during dump of " + db + " - Error: " + err.Error())
 		notify.FailedDBList = append(notify.FailedDBList, db+" - Dump Error: "+err.Error())
 		FailedDBNames = append(FailedDBNames, db)
 		return
 	}
 
-	for _, writer := range pipeWriters {
-		writer.Close()
+	for i, uploadErr := range results {
+		if uploadErr != nil {
+			logger.Error(strconv.Itoa(i+1) + ") " + db + " - " + "Couldn't upload to " + targets[i].name + "  - Error: " + uploadErr.Error())
+			notify.FailedDBList = append(notify.FailedDBList, db+" to "+targets[i].name+" - Error: "+uploadErr.Error())
+			FailedDBNames = append(FailedDBNames, db)
+		} else {
+			message := strconv.Itoa(i+1) + ") " + db + " - " + "Successfully uploaded to " + targets[i].name
+			logger.Info(message)
+			notify.SuccessfulDBList = append(notify.SuccessfulDBList, db+" to "+targets[i].name)
+		}
 	}
+}
 
-	for i, channel := range uploadDone {
-		select {
-		case uploadErr := <-channel:
-			if uploadErr != nil {
-				logger.Error(strconv.Itoa(i+1) + ") " + db + " - " + "Couldn't upload to S3: " + uploaders[i].instance.Endpoint + "  - Error: " + uploadErr.Error())
-				notify.FailedDBList = append(notify.FailedDBList, db+" to "+uploaders[i].instance.Endpoint+" - Error: "+uploadErr.Error())
-				FailedDBNames = append(FailedDBNames, db)
-			} else {
-				message := strconv.Itoa(i+1) + ") " + db + " - " + "Successfully uploaded to S3: " + uploaders[i].instance.Endpoint
-				logger.Info(message)
-				notify.SuccessfulDBList = append(notify.SuccessfulDBList, db+" to "+uploaders[i].instance.Endpoint)
-			}
-		case <-ctx.Done():
-			logger.Error(strconv.Itoa(i+1) + ") " + db + " - Upload timed out or was cancelled")
-			notify.FailedDBList = append(notify.FailedDBList, db+" to "+uploaders[i].instance.Endpoint+" - Error: timeout")
-			FailedDBNames = append(FailedDBNames, db)
+func streamTargets(db, name string, m *manifest, estimate int64) []streamTarget {
+	switch params.BackupType.Type {
+	case "s3", "minio":
+		return s3StreamTargets(db, name, m, estimate)
+	case "azure":
+		return azureStreamTargets(db, name, m, estimate)
+	case "gcs":
+		return gcsStreamTargets(db, name, m)
+	case "ftp":
+		return ftpStreamTargets(db, name, m)
+	case "sftp":
+		return sftpStreamTargets(db, name, m)
+	}
+	return nil
+}
+
+// streamingBackend reports whether the destination can take a dump while it
+// is being written. SFTP dumps are only streamed with removeLocal, otherwise
+// the local copy in backupDestination is kept as it always was.
+func streamingBackend() bool {
+	switch params.BackupType.Type {
+	case "s3", "minio", "azure", "gcs", "ftp":
+		return true
+	case "sftp":
+		return params.RemoveLocal
+	}
+	return false
+}
+
+func s3StreamTargets(db, name string, m *manifest, estimate int64) []streamTarget {
+	var targets []streamTarget
+	for _, instance := range uploaders {
+		dumpPath := instance.instance.Path + "/" + name
+		partSize := streamPartSize(instance.uploader.PartSize, estimate)
+		if partSize != instance.uploader.PartSize {
+			logger.Info("Using " + strconv.FormatInt(partSize/1024/1024, 10) + " MB parts for " + db + " on " + instance.instance.Bucket + ", the database is " + strconv.FormatInt(estimate/1024/1024, 10) + " MB")
+		}
+		targetName := instance.instance.Endpoint + "/" + instance.instance.Bucket
+		if capacity := streamCapacity(partSize); estimate > capacity {
+			// fails before the dump instead of once it has been uploaded
+			err := errors.New(db + " is " + strconv.FormatInt(estimate/1024/1024, 10) + " MB, larger than the " + strconv.FormatInt(capacity/1024/1024, 10) + " MB a streamed upload can hold on " + targetName)
+			targets = append(targets, streamTarget{name: targetName, upload: func(context.Context, io.Reader) error { return err }})
+			continue
 		}
+		targets = append(targets, streamTarget{
+			name: targetName,
+			upload: func(ctx context.Context, r io.Reader) error {
+				return uploadFileToS3(ctx, "", dumpPath, db, r, &instance, m, partSize)
+			},
+		})
 	}
+	return targets
 }
 
-func upload(name, db, filePath string) {
+func upload(name, db, filePath string, m *manifest) {
 	var err error
+	if m != nil {
+		m.SHA256, m.Size, err = hashFile(filePath)
+		if err != nil {
+			logger.Error("Couldn't calculate the checksum of " + filePath + " - Error: " + err.Error())
+		}
+	}
 	switch params.BackupType.Type {
 	case "s3", "minio":
-		uploadToS3(filePath, name, db)
+		uploadToS3(filePath, name, db, m)
+	case "azure":
+		uploadToAzure(filePath, name, db, m)
+	case "gcs":
+		uploadToGCS(filePath, name, db, m)
+	case "webdav":
+		uploadToWebDAV(filePath, name, db, m)
+	case "filesystem":
+		uploadToFilesystem(filePath, name, db, m)
 	case "sftp":
 		for _, target := range params.BackupType.Info[0].Targets {
-			err = SendSFTP(filePath, name, db, target)
+			err = SendSFTP(filePath, name, db, target, m)
 			if err != nil {
 				// itWorksNow("", false)
 				notify.FailedDBList = append(notify.FailedDBList, db+" - "+name+" - Error: "+err.Error())
@@ -301,9 +394,19 @@ func upload(name, db, filePath string) {
 				notify.SuccessfulDBList = append(notify.SuccessfulDBList, db+" - "+name)
 			}
 		}
+	case "ftp":
+		for _, target := range params.BackupType.Info[0].Targets {
+			err = SendFTP(filePath, name, db, target, m)
+			if err != nil {
+				notify.FailedDBList = append(notify.FailedDBList, db+" - "+name+" - Error: "+err.Error())
+				FailedDBNames = append(FailedDBNames, db)
+			} else {
+				notify.SuccessfulDBList = append(notify.SuccessfulDBList, db+" - "+name)
+			}
+		}
 	case "rsync":
 		for _, target := range params.BackupType.Info[0].Targets {
-			message, err := SendRsync(filePath, name, db, target)
+			message, err := SendRsync(filePath, name, db, target, m)
 			if err != nil {
 				// itWorksNow("", false)
 				notify.FailedDBList = append(notify.FailedDBList, db+" - "+message)
@@ -375,27 +478,7 @@ func cleanupLocal() error {
 			}
 		}
 
-		var toDelete []BackupFile
-
-		re := regexp.MustCompile(`(.+)-(week_\d+|Jan|Feb|Mar|Apr|May|Jun|Jul|Aug|Sep|Oct|Nov|Dec|Mon|Tue|Wed|Thu|Fri|Sat|Sun)`)
-
-		grouped := make(map[string][]BackupFile)
-		for _, f := range backups {
-			filename := f.Name
-
-			dbName := ""
-			matches := re.FindStringSubmatch(filename)
-			if len(matches) > 1 {
-				dbName = matches[1]
-			} else {
-				dbName = filename
-			}
-			grouped[dbName] = append(grouped[dbName], f)
-		}
-
-		for _, group := range grouped {
-			toDelete = append(toDelete, getFilesToDelete(group, period, keep)...)
-		}
+		toDelete := selectExpired(backups, period, keep)
 		for _, f := range toDelete {
 			err := os.Remove(f.Path)
 			if err != nil {
@@ -0,0 +1,72 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+// checksumWriter hashes everything written to it while a dump streams to its
+// destinations
+type checksumWriter struct {
+	hash hash.Hash
+	size int64
+}
+
+func newChecksumWriter() *checksumWriter {
+	return &checksumWriter{hash: sha256.New()}
+}
+
+func (c *checksumWriter) Write(p []byte) (int, error) {
+	c.hash.Write(p)
+	c.size += int64(len(p))
+	return len(p), nil
+}
+
+func (c *checksumWriter) sum() string {
+	return hex.EncodeToString(c.hash.Sum(nil))
+}
+
+func hashReader(r io.Reader) (string, int64, error) {
+	checksum := newChecksumWriter()
+	if _, err := io.Copy(checksum, r); err != nil {
+		return "", 0, err
+	}
+	return checksum.sum(), checksum.size, nil
+}
+
+func hashFile(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	return hashReader(f)
+}
+
+// parseChecksumSidecar reads the hex digest out of a sha256sum style line
+func parseChecksumSidecar(data []byte) (string, error) {
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 || len(fields[0]) != sha256.Size*2 {
+		return "", errors.New("invalid checksum file")
+	}
+	return strings.ToLower(fields[0]), nil
+}
+
+// base64ToHex converts the base64 encoded checksums S3 returns
+func base64ToHex(sum string) string {
+	raw, err := base64.StdEncoding.DecodeString(sum)
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(raw)
+}
+
+func checksumMismatch(path, expected, actual string) error {
+	return errors.New("checksum mismatch for " + path + " - expected: " + expected + " got: " + actual)
+}
@@ -1,7 +1,9 @@
 package backup
 
 import (
+	"regexp"
 	"sort"
+	"strings"
 	"time"
 )
 
@@ -17,6 +19,8 @@ func (a ByTime) Len() int           { return len(a) }
 func (a ByTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a ByTime) Less(i, j int) bool { return a[i].Time.After(a[j].Time) }
 
+var rotatedNameRegex = regexp.MustCompile(`(.+)-(week_\d+|Jan|Feb|Mar|Apr|May|Jun|Jul|Aug|Sep|Oct|Nov|Dec|Mon|Tue|Wed|Thu|Fri|Sat|Sun)`)
+
 func getFilesToDelete(files []BackupFile, period string, keep int) []BackupFile {
 	var toDelete []BackupFile
 	if keep == 0 {
@@ -29,3 +33,80 @@ func getFilesToDelete(files []BackupFile, period string, keep int) []BackupFile
 	}
 	return toDelete
 }
+
+// selectExpired groups backups per database and returns the ones beyond keep.
+// Sidecar files are not counted, they are returned together with their
+// artifact or when the artifact no longer exists.
+func selectExpired(backups []BackupFile, period string, keep int) []BackupFile {
+	var toDelete []BackupFile
+	artifacts := make(map[string]bool)
+	sidecars := make(map[string][]BackupFile)
+	grouped := make(map[string][]BackupFile)
+	for _, f := range backups {
+		if isSidecar(f.Path) {
+			sidecars[sidecarOwner(f.Path)] = append(sidecars[sidecarOwner(f.Path)], f)
+			continue
+		}
+		artifacts[f.Path] = true
+		parts := strings.Split(f.Name, "/")
+		filename := parts[len(parts)-1]
+
+		dbName := ""
+		matches := rotatedNameRegex.FindStringSubmatch(filename)
+		if len(matches) > 1 {
+			dbName = matches[1]
+		} else {
+			dbName = filename
+		}
+		grouped[dbName] = append(grouped[dbName], f)
+	}
+
+	for _, group := range grouped {
+		toDelete = append(toDelete, getFilesToDelete(group, period, keep)...)
+	}
+	for _, f := range toDelete {
+		toDelete = append(toDelete, sidecars[f.Path]...)
+		delete(sidecars, f.Path)
+	}
+	for owner, files := range sidecars {
+		if !artifacts[owner] {
+			toDelete = append(toDelete, files...)
+		}
+	}
+	return toDelete
+}
+
+// applyRetention runs selectExpired over the rotation folders that have a keep
+// count. list returns the backups stored under a folder, remove deletes one.
+func applyRetention(list func(dir string) ([]BackupFile, error), remove func(f BackupFile) error) error {
+	tiers := []struct {
+		dir    string
+		keep   int
+		period string
+	}{
+		{"Daily", params.Rotation.Keep.Daily, "daily"},
+		{"Weekly", params.Rotation.Keep.Weekly, "weekly"},
+		{"Monthly", params.Rotation.Keep.Monthly, "monthly"},
+	}
+	for _, tier := range tiers {
+		if tier.keep == 0 {
+			continue
+		}
+		backups, err := list(tier.dir)
+		if err != nil {
+			return err
+		}
+		for _, f := range selectExpired(backups, tier.period, tier.keep) {
+			if err := remove(f); err != nil {
+				logger.Error("Failed to delete old backup " + f.Path + ": " + err.Error())
+			} else {
+				logger.Info("Deleted old backup: " + f.Path)
+			}
+		}
+	}
+	return nil
+}
+
+func retentionEnabled() bool {
+	return params.Rotation.Keep.Daily > 0 || params.Rotation.Keep.Weekly > 0 || params.Rotation.Keep.Monthly > 0
+}
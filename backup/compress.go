@@ -0,0 +1,150 @@
+package backup
+
+import (
+	"errors"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/ulikunitz/xz"
+)
+
+// xz has no presets in Go, so levels 0-9 map to the dictionary sizes xz(1) uses for -0 .. -9
+var xzDictCaps = []int{256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20, 8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func compressionCodec() string {
+	if params.Database == "mssql" {
+		// BACKUP DATABASE ... WITH COMPRESSION runs on the server
+		return "none"
+	}
+	return params.Compression.Algorithm
+}
+
+func compressionExtension() string {
+	switch compressionCodec() {
+	case "gzip", "pgzip":
+		return ".gz"
+	case "zstd":
+		return ".zst"
+	case "xz":
+		return ".xz"
+	default:
+		return ""
+	}
+}
+
+// artifactExtension is appended to the engine's own extension (.dump, .sql)
+func artifactExtension() string {
+	return compressionExtension() + encryptionExtension()
+}
+
+// compressionLevel returns the configured level, or def if there is none
+func compressionLevel(def int) int {
+	if params.Compression.Level == nil {
+		return def
+	}
+	return *params.Compression.Level
+}
+
+// newCompressor wraps w with the configured codec. Closing the returned writer
+// flushes the codec but leaves w open.
+func newCompressor(w io.Writer) (io.WriteCloser, error) {
+	switch compressionCodec() {
+	case "gzip":
+		return gzip.NewWriterLevel(w, compressionLevel(gzip.DefaultCompression))
+	case "pgzip":
+		gw, err := pgzip.NewWriterLevel(w, compressionLevel(pgzip.DefaultCompression))
+		if err != nil {
+			return nil, err
+		}
+		if err := gw.SetConcurrency(1<<20, runtime.NumCPU()*2); err != nil {
+			return nil, err
+		}
+		return gw, nil
+	case "zstd":
+		level := compressionLevel(3)
+		if level == 0 {
+			// zstd's own default level
+			level = 3
+		}
+		if level < 1 || level > 22 {
+			return nil, errors.New("invalid zstd compression level " + strconv.Itoa(level) + ", should be between 1 and 22")
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)), zstd.WithEncoderConcurrency(runtime.NumCPU()))
+	case "xz":
+		level := compressionLevel(6)
+		if level < 0 || level >= len(xzDictCaps) {
+			return nil, errors.New("invalid xz compression level " + strconv.Itoa(level) + ", should be between 0 and 9")
+		}
+		return xz.WriterConfig{DictCap: xzDictCaps[level]}.NewWriter(w)
+	case "none":
+		return nopWriteCloser{w}, nil
+	default:
+		return nil, errors.New("unknown compression algorithm " + params.Compression.Algorithm + ", should be one of gzip, pgzip, zstd, xz or none")
+	}
+}
+
+// writeArtifact compresses and, when archivePass is set, encrypts everything
+// read from r into dumpPath.
+func writeArtifact(r io.Reader, dumpPath string) error {
+	f, err := os.Create(dumpPath)
+	if err != nil {
+		return err
+	}
+	w, err := newArtifactWriter(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	_, err = io.Copy(w, r)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// newDecompressor picks the codec from the artifact's extension, name should
+// no longer carry the encryption extension.
+func newDecompressor(r io.Reader, name string) (io.ReadCloser, error) {
+	switch {
+	case strings.HasSuffix(name, ".gz"):
+		return pgzip.NewReader(r)
+	case strings.HasSuffix(name, ".zst"):
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case strings.HasSuffix(name, ".xz"):
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(xr), nil
+	default:
+		return io.NopCloser(r), nil
+	}
+}
+
+func trimCompressionExtension(name string) string {
+	for _, ext := range []string{".gz", ".zst", ".xz"} {
+		if strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext)
+		}
+	}
+	return name
+}
@@ -0,0 +1,14 @@
+//go:build linux
+
+package backup
+
+import "syscall"
+
+// freeSpace returns the bytes available to this user on the filesystem of dir
+func freeSpace(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * stat.Bsize, nil
+}
@@ -0,0 +1,255 @@
+package backup
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// encryptionMode is one of age-scrypt (archivePass), age (public keys),
+// openpgp or empty when backups aren't encrypted
+func encryptionMode() string {
+	switch {
+	case params.ArchivePass != "":
+		return "age-scrypt"
+	case len(params.Encryption.Recipients) > 0:
+		return "age"
+	case len(params.Encryption.PGPKeys) > 0:
+		return "openpgp"
+	default:
+		return ""
+	}
+}
+
+func encryptionEnabled() bool {
+	return encryptionMode() != ""
+}
+
+func encryptionExtension() string {
+	switch encryptionMode() {
+	case "age-scrypt", "age":
+		return ".age"
+	case "openpgp":
+		return ".gpg"
+	default:
+		return ""
+	}
+}
+
+func ageRecipients() ([]age.Recipient, error) {
+	var recipients []age.Recipient
+	for _, key := range params.Encryption.Recipients {
+		key = strings.TrimSpace(key)
+		var recipient age.Recipient
+		var err error
+		if strings.HasPrefix(key, "age1") {
+			recipient, err = age.ParseX25519Recipient(key)
+		} else {
+			recipient, err = agessh.ParseRecipient(key)
+		}
+		if err != nil {
+			return nil, errors.New("invalid encryption recipient " + key + " - " + err.Error())
+		}
+		recipients = append(recipients, recipient)
+	}
+	return recipients, nil
+}
+
+func pgpRecipients() (openpgp.EntityList, error) {
+	var entities openpgp.EntityList
+	for _, path := range params.Encryption.PGPKeys {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		keyRing, err := openpgp.ReadArmoredKeyRing(f)
+		f.Close()
+		if err != nil {
+			return nil, errors.New("couldn't read OpenPGP key " + path + " - " + err.Error())
+		}
+		entities = append(entities, keyRing...)
+	}
+	return entities, nil
+}
+
+// newEncryptor wraps w with the configured encryption. Backups encrypted with
+// archivePass or age recipients can be decrypted with `age -d`, OpenPGP ones
+// with `gpg -d`. Closing the returned writer writes the final chunk but leaves
+// w open.
+func newEncryptor(w io.Writer) (io.WriteCloser, error) {
+	switch encryptionMode() {
+	case "age-scrypt":
+		recipient, err := age.NewScryptRecipient(params.ArchivePass)
+		if err != nil {
+			return nil, err
+		}
+		return age.Encrypt(w, recipient)
+	case "age":
+		recipients, err := ageRecipients()
+		if err != nil {
+			return nil, err
+		}
+		return age.Encrypt(w, recipients...)
+	case "openpgp":
+		entities, err := pgpRecipients()
+		if err != nil {
+			return nil, err
+		}
+		return openpgp.Encrypt(w, entities, nil, &openpgp.FileHints{IsBinary: true}, nil)
+	default:
+		return nopWriteCloser{w}, nil
+	}
+}
+
+// newDecryptor undoes newEncryptor based on the artifact's extension.
+// identityFile holds age identities, an SSH private key or an armored OpenPGP
+// private key. archivePass is tried as well for age artifacts.
+func newDecryptor(r io.Reader, name, identityFile string) (io.Reader, error) {
+	switch {
+	case strings.HasSuffix(name, ".age"):
+		var identities []age.Identity
+		if params.ArchivePass != "" {
+			identity, err := age.NewScryptIdentity(params.ArchivePass)
+			if err != nil {
+				return nil, err
+			}
+			identities = append(identities, identity)
+		}
+		if identityFile != "" {
+			data, err := os.ReadFile(identityFile)
+			if err != nil {
+				return nil, err
+			}
+			if strings.Contains(string(data), "PRIVATE KEY-----") {
+				identity, err := agessh.ParseIdentity(data)
+				if err != nil {
+					return nil, errors.New("couldn't parse SSH identity " + identityFile + " - " + err.Error())
+				}
+				identities = append(identities, identity)
+			} else {
+				parsed, err := age.ParseIdentities(strings.NewReader(string(data)))
+				if err != nil {
+					return nil, errors.New("couldn't parse age identities " + identityFile + " - " + err.Error())
+				}
+				identities = append(identities, parsed...)
+			}
+		}
+		if len(identities) == 0 {
+			return nil, errors.New(name + " is encrypted, an identity file or archivePass is needed to decrypt it")
+		}
+		return age.Decrypt(r, identities...)
+	case strings.HasSuffix(name, ".gpg"):
+		if identityFile == "" {
+			return nil, errors.New(name + " is encrypted, an OpenPGP private key is needed to decrypt it")
+		}
+		f, err := os.Open(identityFile)
+		if err != nil {
+			return nil, err
+		}
+		keyRing, err := openpgp.ReadArmoredKeyRing(f)
+		f.Close()
+		if err != nil {
+			return nil, errors.New("couldn't read OpenPGP private key " + identityFile + " - " + err.Error())
+		}
+		prompt := func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+			passphrase := []byte(os.Getenv("MONODB_BACKUP_KEY_PASSPHRASE"))
+			for _, key := range keys {
+				if key.PrivateKey != nil && key.PrivateKey.Encrypted {
+					if err := key.PrivateKey.Decrypt(passphrase); err != nil {
+						return nil, errors.New("couldn't unlock OpenPGP private key, set MONODB_BACKUP_KEY_PASSPHRASE - " + err.Error())
+					}
+				}
+			}
+			return nil, nil
+		}
+		md, err := openpgp.ReadMessage(r, keyRing, prompt, nil)
+		if err != nil {
+			return nil, err
+		}
+		return md.UnverifiedBody, nil
+	default:
+		return r, nil
+	}
+}
+
+// artifactWriter compresses first and encrypts the compressed stream
+type artifactWriter struct {
+	compressor io.WriteCloser
+	encryptor  io.WriteCloser
+}
+
+func (a *artifactWriter) Write(p []byte) (int, error) {
+	return a.compressor.Write(p)
+}
+
+func (a *artifactWriter) Close() error {
+	err := a.compressor.Close()
+	if closeErr := a.encryptor.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// newArtifactWriter returns the writer every dump goes through before it
+// reaches a file or an upload. Closing it leaves w open.
+func newArtifactWriter(w io.Writer) (io.WriteCloser, error) {
+	encryptor, err := newEncryptor(w)
+	if err != nil {
+		return nil, err
+	}
+	compressor, err := newCompressor(encryptor)
+	if err != nil {
+		return nil, err
+	}
+	return &artifactWriter{compressor: compressor, encryptor: encryptor}, nil
+}
+
+// encryptFile encrypts a dump that was written by the database server itself
+// and replaces it with the encrypted copy.
+func encryptFile(path string) (string, error) {
+	if !encryptionEnabled() {
+		return path, nil
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	encryptedPath := path + encryptionExtension()
+	dst, err := os.Create(encryptedPath)
+	if err != nil {
+		return "", err
+	}
+	encryptor, err := newEncryptor(dst)
+	if err != nil {
+		dst.Close()
+		return "", err
+	}
+	_, err = io.Copy(encryptor, src)
+	if closeErr := encryptor.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(encryptedPath)
+		return "", err
+	}
+	return encryptedPath, os.Remove(path)
+}
+
+func trimEncryptionExtension(name string) string {
+	for _, ext := range []string{".age", ".gpg"} {
+		if strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext)
+		}
+	}
+	return name
+}
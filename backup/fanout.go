@@ -0,0 +1,374 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// streamTarget is one destination of a streamed dump. upload reads the dump
+// from r until EOF and returns once it is stored, or once ctx is done.
+type streamTarget struct {
+	name   string
+	upload func(ctx context.Context, r io.Reader) error
+}
+
+const fanOutChunkSize = 32 * 1024
+
+var errAllTargetsFailed = errors.New("every target of the dump failed")
+
+// fanOutBranch feeds one target from its own buffer so that a slow target
+// only falls behind instead of holding back the others.
+type fanOutBranch struct {
+	target   streamTarget
+	chunks   chan []byte
+	pipe     *io.PipeWriter
+	cancel   context.CancelFunc // stops an upload stuck on its destination
+	done     chan struct{}
+	err      error // upload's error, set before done is closed
+	abort    error // set before chunks is closed when the upload shouldn't complete
+	detached bool
+}
+
+// fanOut copies a dump to every target. Without a spool each target gets a
+// memory buffer of streaming.bufferSize and is detached as failed once its
+// buffer has been full for streaming.stallTimeout. With streaming.spoolDir the
+// dump is written to disk, targets read it from there at their own pace and
+// the ones that failed are retried from the spool after the dump. The spool is
+// kept for the targets that fail again, to be resumed by a later run.
+type fanOut struct {
+	ctx      context.Context
+	branches []*fanOutBranch
+	stall    time.Duration
+	spool    *spool
+	db       string
+	name     string
+}
+
+func newFanOut(ctx context.Context, db, name string, targets []streamTarget) (*fanOut, error) {
+	f := &fanOut{ctx: ctx, stall: time.Duration(params.Streaming.StallTimeout) * time.Second, db: db, name: name}
+	if params.Streaming.SpoolDir != "" {
+		s, err := newSpool(params.Streaming.SpoolDir, name)
+		if err != nil {
+			return nil, err
+		}
+		f.spool = s
+	}
+	capacity := int(params.Streaming.BufferSize * 1024 * 1024 / fanOutChunkSize)
+	if capacity < 1 {
+		capacity = 1
+	}
+	for _, target := range targets {
+		branchCtx, cancel := context.WithCancel(ctx)
+		b := &fanOutBranch{target: target, cancel: cancel, done: make(chan struct{})}
+		f.branches = append(f.branches, b)
+		if f.spool != nil {
+			go func() {
+				defer close(b.done)
+				defer cancel()
+				r, err := f.spool.reader()
+				if err != nil {
+					b.err = err
+					return
+				}
+				defer r.Close()
+				b.err = b.target.upload(branchCtx, r)
+			}()
+			continue
+		}
+		b.chunks = make(chan []byte, capacity)
+		pipeReader, pipeWriter := io.Pipe()
+		b.pipe = pipeWriter
+		go func() {
+			for chunk := range b.chunks {
+				if _, err := pipeWriter.Write(chunk); err != nil {
+					return
+				}
+			}
+			if b.abort != nil {
+				pipeWriter.CloseWithError(b.abort)
+			} else {
+				pipeWriter.Close()
+			}
+		}()
+		go func() {
+			defer close(b.done)
+			defer cancel()
+			b.err = b.target.upload(branchCtx, pipeReader)
+			if b.err != nil {
+				// unblocks the pump, the branch is detached on the next write
+				pipeReader.CloseWithError(b.err)
+			}
+		}()
+	}
+	return f, nil
+}
+
+func (f *fanOut) Write(p []byte) (int, error) {
+	if f.spool != nil {
+		return f.spool.Write(p)
+	}
+	for written := 0; written < len(p); {
+		n := len(p) - written
+		if n > fanOutChunkSize {
+			n = fanOutChunkSize
+		}
+		chunk := make([]byte, n)
+		copy(chunk, p[written:written+n])
+		f.send(chunk)
+		written += n
+	}
+	for _, b := range f.branches {
+		if !b.detached {
+			return len(p), nil
+		}
+	}
+	return 0, errAllTargetsFailed
+}
+
+func (f *fanOut) send(chunk []byte) {
+	for _, b := range f.branches {
+		if b.detached {
+			continue
+		}
+		select {
+		case b.chunks <- chunk:
+			continue
+		case <-b.done:
+			f.detach(b, b.err)
+			continue
+		default:
+		}
+		timer := time.NewTimer(f.stall)
+		select {
+		case b.chunks <- chunk:
+		case <-b.done:
+			f.detach(b, b.err)
+		case <-timer.C:
+			logger.Error("Detaching " + b.target.name + ", it couldn't keep up with the dump for " + f.stall.String())
+			f.detach(b, errors.New("detached, couldn't keep up with the dump for "+f.stall.String()))
+		}
+		timer.Stop()
+	}
+}
+
+func (f *fanOut) detach(b *fanOutBranch, reason error) {
+	if reason == nil {
+		reason = errors.New("upload finished before the dump")
+	}
+	b.detached = true
+	b.abort = reason
+	// the pump may be blocked writing to an upload that stopped reading, and
+	// the upload on a destination that stopped responding
+	b.pipe.CloseWithError(reason)
+	b.cancel()
+	close(b.chunks)
+}
+
+// finish ends the dump for every target and waits for the uploads. A failed
+// dump aborts them. Detached uploads are cancelled and the others end with
+// the job's context, so the wait is bounded. Returns each target's result in the order of targets.
+func (f *fanOut) finish(dumpErr error) []error {
+	if f.spool != nil {
+		f.spool.close(dumpErr)
+	} else {
+		for _, b := range f.branches {
+			if !b.detached {
+				b.abort = dumpErr
+				close(b.chunks)
+			}
+		}
+	}
+
+	results := make([]error, len(f.branches))
+	for i, b := range f.branches {
+		<-b.done
+		results[i] = b.err
+		if b.detached {
+			// the reason it was detached rather than the cancelled upload's error
+			results[i] = b.abort
+		}
+	}
+
+	if f.spool == nil {
+		return results
+	}
+	if dumpErr != nil {
+		f.spool.remove()
+		return results
+	}
+	for i, b := range f.branches {
+		if results[i] == nil {
+			continue
+		}
+		logger.Info("Retrying " + b.target.name + " from the spool " + f.spool.path + " - previous error: " + results[i].Error())
+		file, err := os.Open(f.spool.path)
+		if err != nil {
+			results[i] = err
+			continue
+		}
+		results[i] = b.target.upload(f.ctx, file)
+		file.Close()
+	}
+	f.keepSpool(results)
+	return results
+}
+
+// keepSpool saves an upload state for each target that failed, the spool is
+// removed once no target needs it
+func (f *fanOut) keepSpool(results []error) {
+	kept := false
+	for i, b := range f.branches {
+		if results[i] == nil {
+			continue
+		}
+		if !resumeEnabled() {
+			logger.Error("Couldn't keep the spool " + f.spool.path + " for " + b.target.name + ", resume.stateDir is not set")
+			continue
+		}
+		state := newUploadState("spool", b.target.name, f.name, f.spool.path, f.db)
+		if state == nil {
+			continue
+		}
+		state.save()
+		kept = true
+		logger.Info("Keeping the spool " + f.spool.path + " to retry " + b.target.name + " in the next run")
+	}
+	if !kept {
+		f.spool.remove()
+	}
+}
+
+// resumeSpoolUpload retries the upload of a kept spool to the target that
+// failed, and removes the spool once no other target is waiting for it
+func resumeSpoolUpload(state *uploadState, m *manifest) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(params.CtxCancel)*time.Hour)
+	defer cancel()
+	err := errors.New(state.Target + " is no longer a target")
+	for _, target := range streamTargets(state.Database, state.Key, m, state.Size) {
+		if target.name != state.Target {
+			continue
+		}
+		file, openErr := os.Open(state.Source)
+		if openErr != nil {
+			return openErr
+		}
+		err = target.upload(ctx, file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+		break
+	}
+	state.remove()
+	for _, other := range pendingUploads(state.Database) {
+		if other.Source == state.Source {
+			return err
+		}
+	}
+	(&spool{path: state.Source}).remove()
+	return err
+}
+
+// spool is a file the dump is written to while targets read it behind the
+// writer
+type spool struct {
+	path   string
+	file   *os.File
+	mu     sync.Mutex
+	cond   *sync.Cond
+	size   int64
+	closed bool
+	err    error
+}
+
+func newSpool(dir, name string) (*spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(dir, filepath.Base(name)+".spool-*")
+	if err != nil {
+		return nil, err
+	}
+	s := &spool{path: file.Name(), file: file}
+	s.cond = sync.NewCond(&s.mu)
+	return s, nil
+}
+
+func (s *spool) Write(p []byte) (int, error) {
+	n, err := s.file.Write(p)
+	s.mu.Lock()
+	s.size += int64(n)
+	s.mu.Unlock()
+	s.cond.Broadcast()
+	return n, err
+}
+
+func (s *spool) close(err error) {
+	closeErr := s.file.Close()
+	s.mu.Lock()
+	s.closed = true
+	s.err = err
+	if s.err == nil {
+		s.err = closeErr
+	}
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+func (s *spool) remove() {
+	if err := os.Remove(s.path); err != nil {
+		logger.Error("Couldn't remove spool file " + s.path + " - Error: " + err.Error())
+	}
+}
+
+func (s *spool) reader() (*spoolReader, error) {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	return &spoolReader{spool: s, file: file}, nil
+}
+
+// spoolReader reads a spool while it is being written, waiting for more data
+// instead of returning EOF until the dump is finished
+type spoolReader struct {
+	spool  *spool
+	file   *os.File
+	offset int64
+}
+
+func (r *spoolReader) Read(p []byte) (int, error) {
+	s := r.spool
+	s.mu.Lock()
+	for r.offset >= s.size && !s.closed {
+		s.cond.Wait()
+	}
+	available := s.size - r.offset
+	closed, err := s.closed, s.err
+	s.mu.Unlock()
+
+	if available == 0 {
+		if closed && err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > available {
+		p = p[:available]
+	}
+	n, readErr := r.file.Read(p)
+	r.offset += int64(n)
+	if readErr == io.EOF {
+		readErr = nil
+	}
+	return n, readErr
+}
+
+func (r *spoolReader) Close() error {
+	return r.file.Close()
+}
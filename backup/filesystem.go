@@ -0,0 +1,215 @@
+package backup
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"monodb-backup/config"
+	"monodb-backup/notify"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+func uploadToFilesystem(src, dst, db string, m *manifest) {
+	for _, info := range params.BackupType.Info {
+		err := copyToFilesystem(src, filepath.Join(info.Path, nameWithPath(dst)), db, info, m)
+		if err != nil {
+			notify.FailedDBList = append(notify.FailedDBList, db+" - "+src+" - "+err.Error())
+			FailedDBNames = append(FailedDBNames, db)
+		} else {
+			notify.SuccessfulDBList = append(notify.SuccessfulDBList, db+" - "+src)
+		}
+	}
+}
+
+func copyToFilesystem(src, dst, db string, info config.BackupTypeInfo, m *manifest) error {
+	throttle, err := newThrottle(info.Bandwidth)
+	if err != nil {
+		logger.Error("Invalid bandwidth settings for " + info.Path + " - Error: " + err.Error())
+		return err
+	}
+	if err := copyFileAtomic(src, dst, throttle); err != nil {
+		logger.Error("Couldn't copy " + src + " to " + dst + " - Error: " + err.Error())
+		return err
+	}
+	if err := verifyFilesystemCopy(dst, m); err != nil {
+		return err
+	}
+	if err := writeSidecarsFilesystem(dst, m); err != nil {
+		return err
+	}
+	logger.Info("Successfully copied " + src + " to " + dst)
+
+	if params.Rotation.Enabled {
+		if db == "mysql" {
+			db = db + "_users"
+		}
+		shouldRotate, name := rotate(db, info.Path)
+		if shouldRotate {
+			extension := strings.Split(filepath.Base(dst), ".")
+			for i := 1; i < len(extension); i++ {
+				name = name + "." + extension[i]
+			}
+			newDst := filepath.Join(info.Path, name)
+			if err := rotateOnFilesystem(dst, newDst, info.HardLink, throttle); err != nil {
+				logger.Error("Couldn't create copy of " + dst + " at " + newDst + " for rotation - Error: " + err.Error())
+				return err
+			}
+			if err := writeSidecarsFilesystem(newDst, m); err != nil {
+				return err
+			}
+			updateRotatedTimestamp(db, info.Path)
+			logger.Info("Successfully created a copy of " + dst + " for rotation at " + newDst)
+		}
+
+		if retentionEnabled() {
+			if err := cleanupFilesystem(info.Path); err != nil {
+				logger.Error("Error during filesystem cleanup: " + err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// copyFileAtomic copies src next to dst under a temporary name and renames it
+// once it is synced, so a crash or a full disk never leaves a truncated dump
+// under the final name
+func copyFileAtomic(src, dst string, throttle *throttle) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return writeFileAtomic(dst, throttle.reader(in))
+}
+
+func writeFileAtomic(dst string, r io.Reader) error {
+	dir := filepath.Dir(dst)
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(dst)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir makes the rename itself durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// rotateOnFilesystem hard links the rotation copy if asked to, falling back to
+// a copy when the filesystem doesn't support links. Linking is safe because
+// dumps are always replaced by a rename, never rewritten in place.
+func rotateOnFilesystem(src, dst string, hardLink bool, throttle *throttle) error {
+	if hardLink {
+		if err := os.MkdirAll(filepath.Dir(dst), 0770); err != nil {
+			return err
+		}
+		// a link can't replace an existing file, the old copy goes first
+		if err := os.Remove(dst); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		err := os.Link(src, dst)
+		if err == nil {
+			return syncDir(filepath.Dir(dst))
+		}
+		logger.Error("Couldn't hard link " + src + " to " + dst + ", copying it instead - Error: " + err.Error())
+	}
+	return copyFileAtomic(src, dst, throttle)
+}
+
+func verifyFilesystemCopy(dst string, m *manifest) error {
+	if m == nil || m.SHA256 == "" {
+		return nil
+	}
+	info, err := os.Stat(dst)
+	if err != nil {
+		logger.Error("Couldn't stat " + dst + " - Error: " + err.Error())
+		return err
+	}
+	if info.Size() != m.Size {
+		err = errors.New("size mismatch for " + dst + " - expected: " + strconv.FormatInt(m.Size, 10) + " got: " + strconv.FormatInt(info.Size(), 10))
+		logger.Error(err.Error())
+		return err
+	}
+	if !params.Checksum.VerifyUpload {
+		return nil
+	}
+	actual, _, err := hashFile(dst)
+	if err != nil {
+		logger.Error("Couldn't read " + dst + " to verify - Error: " + err.Error())
+		return err
+	}
+	if actual != m.SHA256 {
+		err = checksumMismatch(dst, m.SHA256, actual)
+		logger.Error(err.Error())
+		return err
+	}
+	logger.Info("Verified " + dst + ", sha256: " + actual)
+	return nil
+}
+
+func writeSidecarsFilesystem(dst string, m *manifest) error {
+	for _, sc := range m.sidecars(filepath.ToSlash(dst)) {
+		if err := writeFileAtomic(dst+sc.suffix, bytes.NewReader(sc.data)); err != nil {
+			logger.Error("Couldn't write file " + dst + sc.suffix + " - Error: " + err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+func cleanupFilesystem(root string) error {
+	list := func(dir string) ([]BackupFile, error) {
+		var backups []BackupFile
+		err := filepath.WalkDir(filepath.Join(root, dir), func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			// skip directories and copies that are still being written
+			if d.IsDir() || strings.Contains(d.Name(), ".tmp-") {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			backups = append(backups, BackupFile{Name: d.Name(), Time: info.ModTime(), Path: path})
+			return nil
+		})
+		return backups, err
+	}
+	remove := func(f BackupFile) error {
+		return os.Remove(f.Path)
+	}
+	return applyRetention(list, remove)
+}
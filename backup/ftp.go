@@ -0,0 +1,305 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"monodb-backup/config"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+func SendFTP(srcPath, dstPath, db string, target config.Target, m *manifest) error {
+	return sendFTP(context.Background(), srcPath, target.Path+"/"+nameWithPath(dstPath), db, nil, target, m)
+}
+
+// ConnectToFTP logs in over plain FTP, explicit FTPS or implicit FTPS. Data
+// connections are always passive, EPSV with a fallback to PASV.
+func ConnectToFTP(target config.Target) (*ftp.ServerConn, error) {
+	return connectToFTP(context.Background(), target)
+}
+
+// connectToFTP dials the control and data connections itself so that they are
+// closed once ctx is done, a transfer blocked on a server that stopped
+// responding returns instead of holding the dump
+func connectToFTP(ctx context.Context, target config.Target) (*ftp.ServerConn, error) {
+	port := target.Port
+	if port == "" {
+		port = "21"
+		if target.TLS == "implicit" {
+			port = "990"
+		}
+	}
+	tlsConfig := &tls.Config{ServerName: target.Host, InsecureSkipVerify: target.InsecureSkipVerify, MinVersion: tls.VersionTLS12}
+	options := []ftp.DialOption{}
+	switch target.TLS {
+	case "explicit":
+		options = append(options, ftp.DialWithExplicitTLS(tlsConfig))
+	case "implicit":
+		options = append(options, ftp.DialWithTLS(tlsConfig))
+	case "":
+	default:
+		return nil, errors.New("unknown FTP TLS mode " + target.TLS + ", expected explicit or implicit")
+	}
+	// with a dial function the library leaves TLS to it: every connection of
+	// implicit FTPS and the data connections of explicit FTPS, whose control
+	// connection is upgraded after AUTH TLS
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	control := true
+	dial := func(network, address string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		context.AfterFunc(ctx, func() { conn.Close() })
+		secure := target.TLS == "implicit" || (target.TLS == "explicit" && !control)
+		control = false
+		if secure {
+			return tls.Client(conn, tlsConfig), nil
+		}
+		return conn, nil
+	}
+	options = append(options, ftp.DialWithDialFunc(dial))
+	conn, err := ftp.Dial(net.JoinHostPort(target.Host, port), options...)
+	if err != nil {
+		logger.Error("Couldn't connect to FTP server " + target.Host + " - Error: " + err.Error())
+		return nil, err
+	}
+	user := target.User
+	if user == "" {
+		user = "anonymous"
+	}
+	if err := conn.Login(user, target.Password); err != nil {
+		conn.Quit()
+		logger.Error("Couldn't log in to FTP server " + target.Host + " as " + user + " - Error: " + err.Error())
+		return nil, err
+	}
+	return conn, nil
+}
+
+// sendFTP uploads srcPath, or reader while a dump is streamed into it
+func sendFTP(ctx context.Context, srcPath, dstPath, db string, reader io.Reader, target config.Target, m *manifest) error {
+	streaming := reader != nil
+	if streaming {
+		srcPath = db
+	}
+	logger.Info("FTP transfer started.\n Source: " + srcPath + " - Destination: " + target.Host + ":" + dstPath)
+	conn, err := connectToFTP(ctx, target)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := conn.Quit(); err != nil {
+			logger.Error("Couldn't close FTP connection - Error: " + err.Error())
+		}
+	}()
+
+	var src *os.File
+	if !streaming {
+		src, err = os.Open(srcPath)
+		if err != nil {
+			logger.Error("Couldn't open source file " + srcPath + " for copying - Error: " + err.Error())
+			return err
+		}
+		defer src.Close()
+		reader = src
+	}
+
+	if err = sendOverFTP(srcPath, dstPath, reader, target, conn); err != nil {
+		return err
+	}
+	if err = verifyFTPUpload(dstPath, m, target, conn); err != nil {
+		return err
+	}
+	if err = writeSidecarsFTP(dstPath, m, target, conn); err != nil {
+		return err
+	}
+
+	if params.Rotation.Enabled {
+		shouldRotate, newDst := rotate(db, target.Host)
+		if shouldRotate {
+			extension := strings.Split(dstPath, ".")
+			for i := 1; i < len(extension); i++ {
+				newDst = newDst + "." + extension[i]
+			}
+			newDst = target.Path + "/" + newDst
+			// FTP can't copy on the server, the local dump is sent again or a
+			// streamed one is read back over a second connection
+			if streaming {
+				err = relayOnFTP(dstPath, newDst, target, conn)
+			} else if _, err = src.Seek(0, io.SeekStart); err == nil {
+				err = sendOverFTP(srcPath, newDst, src, target, conn)
+			}
+			if err != nil {
+				logger.Error("Couldn't create copy of " + target.Host + ":" + dstPath + " at " + newDst + " for rotation - Error: " + err.Error())
+				return err
+			}
+			if err = verifyFTPUpload(newDst, m, target, conn); err != nil {
+				return err
+			}
+			if err = writeSidecarsFTP(newDst, m, target, conn); err != nil {
+				return err
+			}
+			updateRotatedTimestamp(db, target.Host)
+		}
+	}
+
+	if retentionEnabled() {
+		if err := CleanupFTP(target, conn); err != nil {
+			logger.Error("Error during FTP cleanup: " + err.Error())
+		}
+	}
+	return nil
+}
+
+func sendOverFTP(srcPath, dstPath string, reader io.Reader, target config.Target, conn *ftp.ServerConn) error {
+	dir := path.Dir(dstPath)
+	if err := ftpMkdirAll(conn, dir); err != nil {
+		logger.Error("Couldn't create folders " + dir + " - Error: " + err.Error())
+		return err
+	}
+	throttle, err := newThrottle(target.Bandwidth)
+	if err != nil {
+		logger.Error("Invalid bandwidth settings for " + target.Host + " - Error: " + err.Error())
+		return err
+	}
+	if err := conn.Stor(dstPath, throttle.reader(reader)); err != nil {
+		logger.Error("Couldn't read from " + srcPath + " to write at " + target.Host + ":" + dstPath + " - Error: " + err.Error())
+		// don't leave a truncated dump behind
+		conn.Delete(dstPath)
+		return err
+	}
+	logger.Info("Successfully copied " + srcPath + " to " + target.Host + ":" + dstPath)
+	return nil
+}
+
+// ftpMkdirAll creates every missing folder of dir. Servers answer MKD of an
+// existing folder with an error, so only the last CWD decides.
+func ftpMkdirAll(conn *ftp.ServerConn, dir string) error {
+	cwd, err := conn.CurrentDir()
+	if err != nil {
+		return err
+	}
+	current := ""
+	if strings.HasPrefix(dir, "/") {
+		current = "/"
+	}
+	for _, part := range strings.Split(dir, "/") {
+		if part == "" || part == "." {
+			continue
+		}
+		current = path.Join(current, part)
+		conn.MakeDir(current)
+	}
+	if err := conn.ChangeDir(dir); err != nil {
+		return err
+	}
+	return conn.ChangeDir(cwd)
+}
+
+// relayOnFTP reads src over a second connection while writing it to dst
+func relayOnFTP(src, dst string, target config.Target, conn *ftp.ServerConn) error {
+	reader, err := ConnectToFTP(target)
+	if err != nil {
+		return err
+	}
+	defer reader.Quit()
+	resp, err := reader.Retr(src)
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+	return sendOverFTP(target.Host+":"+src, dst, resp, target, conn)
+}
+
+func verifyFTPUpload(dstPath string, m *manifest, target config.Target, conn *ftp.ServerConn) error {
+	if m == nil || m.SHA256 == "" {
+		return nil
+	}
+	size, err := conn.FileSize(dstPath)
+	if err != nil {
+		logger.Error("Couldn't get the size of " + target.Host + ":" + dstPath + " - Error: " + err.Error())
+		return err
+	}
+	if size != m.Size {
+		err = errors.New("size mismatch for " + target.Host + ":" + dstPath + " - expected: " + strconv.FormatInt(m.Size, 10) + " got: " + strconv.FormatInt(size, 10))
+		logger.Error(err.Error())
+		return err
+	}
+	return nil
+}
+
+func writeSidecarsFTP(dstPath string, m *manifest, target config.Target, conn *ftp.ServerConn) error {
+	for _, sc := range m.sidecars(dstPath) {
+		if err := conn.Stor(dstPath+sc.suffix, bytes.NewReader(sc.data)); err != nil {
+			logger.Error("Couldn't write file " + target.Host + ":" + dstPath + sc.suffix + " - Error: " + err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// ftpWalk lists the files under dir and its subfolders with MLSD, or LIST on
+// servers without it
+func ftpWalk(conn *ftp.ServerConn, dir string) ([]BackupFile, error) {
+	entries, err := conn.List(dir)
+	if err != nil {
+		return nil, err
+	}
+	var backups []BackupFile
+	for _, e := range entries {
+		if e.Name == "." || e.Name == ".." {
+			continue
+		}
+		p := dir + "/" + e.Name
+		switch e.Type {
+		case ftp.EntryTypeFolder:
+			sub, err := ftpWalk(conn, p)
+			if err != nil {
+				return nil, err
+			}
+			backups = append(backups, sub...)
+		case ftp.EntryTypeFile:
+			backups = append(backups, BackupFile{Name: e.Name, Time: e.Time, Path: p})
+		}
+	}
+	return backups, nil
+}
+
+// CleanupFTP lists the rotation folders and deletes the expired backups
+func CleanupFTP(target config.Target, conn *ftp.ServerConn) error {
+	list := func(dir string) ([]BackupFile, error) {
+		backups, err := ftpWalk(conn, target.Path+"/"+dir)
+		if err != nil {
+			// nothing has been rotated into this folder yet
+			return nil, nil
+		}
+		return backups, nil
+	}
+	remove := func(f BackupFile) error {
+		return conn.Delete(f.Path)
+	}
+	return applyRetention(list, remove)
+}
+
+func ftpStreamTargets(db, name string, m *manifest) []streamTarget {
+	var targets []streamTarget
+	for _, target := range params.BackupType.Info[0].Targets {
+		dst := target.Path + "/" + name
+		targets = append(targets, streamTarget{
+			name: target.Host,
+			upload: func(ctx context.Context, r io.Reader) error {
+				return sendFTP(ctx, "", dst, db, r, target, m)
+			},
+		})
+	}
+	return targets
+}
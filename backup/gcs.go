@@ -0,0 +1,252 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"io"
+	"monodb-backup/config"
+	"monodb-backup/notify"
+	"os"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+type gcsStruct struct {
+	instance  config.BackupTypeInfo
+	bucket    *storage.BucketHandle
+	chunkSize int
+	throttle  *throttle
+}
+
+var gcsTargets []gcsStruct
+
+func InitializeGCS() {
+	if len(gcsTargets) > 0 {
+		return
+	}
+	for _, info := range params.BackupType.Info {
+		client, err := newGCSClient(info)
+		if err != nil {
+			logger.Fatal("Couldn't initialize GCS client for bucket " + info.Bucket + ": " + err.Error())
+			return
+		}
+		throttle, err := newThrottle(info.Bandwidth)
+		if err != nil {
+			logger.Fatal("Invalid bandwidth settings for bucket " + info.Bucket + ": " + err.Error())
+			return
+		}
+		chunkSize := params.PartSize * 1024 * 1024
+		if info.PartSize > 0 {
+			chunkSize = info.PartSize * 1024 * 1024
+		}
+		gcsTargets = append(gcsTargets, gcsStruct{
+			instance:  info,
+			bucket:    client.Bucket(info.Bucket),
+			chunkSize: int(chunkSize),
+			throttle:  throttle,
+		})
+	}
+}
+
+// newGCSClient uses the service account JSON file if given, otherwise the
+// default credentials of the environment, e.g. workload identity. The client
+// talks to fake-gcs-server when STORAGE_EMULATOR_HOST is set.
+func newGCSClient(info config.BackupTypeInfo) (*storage.Client, error) {
+	var opts []option.ClientOption
+	if info.CredentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(info.CredentialsFile))
+	}
+	if info.Endpoint != "" {
+		opts = append(opts, option.WithEndpoint(info.Endpoint))
+	}
+	return storage.NewClient(context.Background(), opts...)
+}
+
+func gcsTargetID(target *gcsStruct) string {
+	return "gs://" + target.instance.Bucket
+}
+
+func gcsMetadata(m *manifest, key string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	metadata := objectFieldValues(m, key)
+	for k, v := range tagMap(m, key) {
+		metadata[k] = v
+	}
+	return metadata
+}
+
+// uploadFileToGCS uploads a dump from src, or from reader while it is being
+// dumped, with a resumable upload sent in chunkSize requests
+func uploadFileToGCS(ctx context.Context, src, dst, db string, reader io.Reader, target *gcsStruct, m *manifest) error {
+	bucketName := target.instance.Bucket
+	if reader == nil {
+		file, err := os.Open(src)
+		if err != nil {
+			logger.Error("Couldn't open file " + src + " to read - Error: " + err.Error())
+			return err
+		}
+		defer file.Close()
+		reader = file
+	} else {
+		src = db
+	}
+
+	// a streamed dump's checksum is only known once it has been uploaded
+	checksumKnown := m != nil && m.SHA256 != ""
+	obj := target.bucket.Object(dst)
+	// cancelling the context before Close aborts the upload, a failed read
+	// must not finalize a truncated object
+	uploadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := obj.NewWriter(uploadCtx)
+	w.ChunkSize = target.chunkSize
+	w.StorageClass = target.instance.StorageClass
+	w.Metadata = gcsMetadata(m, dst)
+	if _, err := io.Copy(w, target.throttle.reader(reader)); err != nil {
+		cancel()
+		w.Close()
+		logger.Error("Couldn't upload " + src + " to GCS\nBucket: " + bucketName + " path: " + dst + "\n Error: " + err.Error())
+		return err
+	}
+	if err := w.Close(); err != nil {
+		logger.Error("Couldn't upload " + src + " to GCS\nBucket: " + bucketName + " path: " + dst + "\n Error: " + err.Error())
+		return err
+	}
+	if !checksumKnown && m != nil {
+		if _, err := obj.Update(ctx, storage.ObjectAttrsToUpdate{Metadata: gcsMetadata(m, dst)}); err != nil {
+			logger.Error("Couldn't set metadata of " + dst + " on GCS\nBucket: " + bucketName + "\n Error: " + err.Error())
+			return err
+		}
+	}
+	if m != nil && m.SHA256 != "" && w.Attrs().Size != m.Size {
+		err := errors.New("size mismatch for " + dst + " - expected: " + strconv.FormatInt(m.Size, 10) + " got: " + strconv.FormatInt(w.Attrs().Size, 10))
+		logger.Error("Couldn't verify " + src + " on GCS\nBucket: " + bucketName + " path: " + dst + "\n Error: " + err.Error())
+		return err
+	}
+	logger.Info("Successfully uploaded " + src + " to GCS\nBucket: " + bucketName + " path: " + dst)
+
+	if err := putSidecarsToGCS(ctx, target, dst, m); err != nil {
+		return err
+	}
+
+	if params.Rotation.Enabled {
+		if db == "mysql" {
+			db = db + "_users"
+		}
+		targetID := gcsTargetID(target)
+		shouldRotate, name := rotate(db, targetID)
+		if shouldRotate {
+			if target.instance.Path != "" {
+				name = target.instance.Path + "/" + name
+			}
+			extension := strings.Split(dst, ".")
+			for i := 1; i < len(extension); i++ {
+				name = name + "." + extension[i]
+			}
+			copier := target.bucket.Object(name).CopierFrom(obj)
+			copier.StorageClass = target.instance.StorageClass
+			copier.Metadata = gcsMetadata(m, name)
+			if _, err := copier.Run(ctx); err != nil {
+				logger.Error("Couldn't create copy of " + src + " for rotation\nBucket: " + bucketName + " path: " + name + "\n Error: " + err.Error())
+				return err
+			}
+			if err := putSidecarsToGCS(ctx, target, name, m); err != nil {
+				return err
+			}
+			updateRotatedTimestamp(db, targetID)
+			logger.Info("Successfully created a copy of " + src + " for rotation\nBucket: " + bucketName + " path: " + name)
+		}
+
+		if retentionEnabled() {
+			if err := cleanupGCS(ctx, target); err != nil {
+				logger.Error("Error during GCS cleanup: " + err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+func putSidecarsToGCS(ctx context.Context, target *gcsStruct, dst string, m *manifest) error {
+	for _, sc := range m.sidecars(dst) {
+		w := target.bucket.Object(dst + sc.suffix).NewWriter(ctx)
+		w.StorageClass = target.instance.StorageClass
+		w.Metadata = gcsMetadata(m, dst)
+		_, err := w.Write(sc.data)
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			logger.Error("Couldn't upload " + dst + sc.suffix + " to GCS\nBucket: " + target.instance.Bucket + "\n Error: " + err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+func cleanupGCS(ctx context.Context, target *gcsStruct) error {
+	list := func(dir string) ([]BackupFile, error) {
+		prefix := dir + "/"
+		if target.instance.Path != "" {
+			prefix = target.instance.Path + "/" + prefix
+		}
+		var backups []BackupFile
+		it := target.bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+		for {
+			attrs, err := it.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			backups = append(backups, BackupFile{Name: attrs.Name, Time: attrs.Updated, Path: attrs.Name})
+		}
+		return backups, nil
+	}
+	remove := func(f BackupFile) error {
+		return target.bucket.Object(f.Path).Delete(ctx)
+	}
+	return applyRetention(list, remove)
+}
+
+func uploadToGCS(src, dst, db string, m *manifest) {
+	ctx := context.Background()
+	for i := range gcsTargets {
+		target := &gcsTargets[i]
+		finalDst := nameWithPath(dst)
+		if target.instance.Path != "" {
+			finalDst = target.instance.Path + "/" + finalDst
+		}
+		err := uploadFileToGCS(ctx, src, finalDst, db, nil, target, m)
+		if err != nil {
+			notify.FailedDBList = append(notify.FailedDBList, db+" - "+src+" - "+err.Error())
+			FailedDBNames = append(FailedDBNames, db)
+		} else {
+			notify.SuccessfulDBList = append(notify.SuccessfulDBList, db+" - "+src)
+		}
+	}
+}
+
+func gcsStreamTargets(db, name string, m *manifest) []streamTarget {
+	var targets []streamTarget
+	for i := range gcsTargets {
+		target := &gcsTargets[i]
+		dst := name
+		if target.instance.Path != "" {
+			dst = target.instance.Path + "/" + name
+		}
+		targets = append(targets, streamTarget{
+			name: gcsTargetID(target),
+			upload: func(ctx context.Context, r io.Reader) error {
+				return uploadFileToGCS(ctx, "", dst, db, r, target, m)
+			},
+		})
+	}
+	return targets
+}
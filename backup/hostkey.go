@@ -0,0 +1,242 @@
+package backup
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"monodb-backup/config"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// knownHostsMu serializes accept-new writes to known_hosts files
+var knownHostsMu sync.Mutex
+
+func knownHostsFile(target config.Target) string {
+	if target.KnownHostsFile != "" {
+		return expandHome(target.KnownHostsFile)
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".ssh/known_hosts"
+	}
+	return filepath.Join(home, ".ssh", "known_hosts")
+}
+
+func sshAddress(target config.Target) string {
+	port := target.Port
+	if port == "" {
+		port = "22"
+	}
+	return net.JoinHostPort(target.Host, port)
+}
+
+// hostKeyCallback verifies the server against the pinned fingerprint or the
+// known_hosts file. The returned algorithms make the server present a key type
+// that is already known instead of failing on a key it has never been seen with.
+func hostKeyCallback(target config.Target) (ssh.HostKeyCallback, []string, error) {
+	if target.HostKeyFingerprint != "" {
+		return pinnedHostKey(target), nil, nil
+	}
+	switch target.HostKeyCheck {
+	case "", "yes", "accept-new":
+	case "no":
+		logger.Info("Host key verification is disabled for " + target.Host)
+		return ssh.InsecureIgnoreHostKey(), nil, nil
+	default:
+		return nil, nil, errors.New("unknown hostKeyCheck " + target.HostKeyCheck + " for " + target.Host + ", expected yes, accept-new or no")
+	}
+
+	file := knownHostsFile(target)
+	if _, err := os.Stat(file); errors.Is(err, os.ErrNotExist) {
+		if target.HostKeyCheck != "accept-new" {
+			return nil, nil, errors.New("known_hosts file " + file + " doesn't exist, add " + target.Host + "'s key to it with ssh-keyscan, pin hostKeyFingerprint or set hostKeyCheck: accept-new")
+		}
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			return nil, nil, err
+		}
+		if err := os.WriteFile(file, nil, 0600); err != nil {
+			return nil, nil, err
+		}
+	}
+	known, err := knownhosts.New(file)
+	if err != nil {
+		return nil, nil, errors.New("couldn't read known_hosts file " + file + ": " + err.Error())
+	}
+
+	callback := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := known(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+		if len(keyErr.Want) > 0 {
+			var want []string
+			for _, k := range keyErr.Want {
+				want = append(want, ssh.FingerprintSHA256(k.Key)+" ("+k.Filename+":"+strconv.Itoa(k.Line)+")")
+			}
+			return errors.New("HOST KEY MISMATCH for " + hostname + ": it presented " + key.Type() + " " + ssh.FingerprintSHA256(key) +
+				" but known_hosts has " + strings.Join(want, ", ") + ". The server's key changed or the connection is being intercepted, refusing to connect")
+		}
+		if target.HostKeyCheck != "accept-new" {
+			return errors.New("host key of " + hostname + " (" + key.Type() + " " + ssh.FingerprintSHA256(key) + ") isn't in " + file +
+				", add it with ssh-keyscan, pin hostKeyFingerprint or set hostKeyCheck: accept-new")
+		}
+		return addKnownHost(file, hostname, remote, key)
+	}
+	return callback, knownHostAlgorithms(known, sshAddress(target)), nil
+}
+
+func pinnedHostKey(target config.Target) ssh.HostKeyCallback {
+	want := target.HostKeyFingerprint
+	if !strings.HasPrefix(want, "SHA256:") {
+		want = "SHA256:" + want
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		got := ssh.FingerprintSHA256(key)
+		if got != want {
+			return errors.New("HOST KEY MISMATCH for " + hostname + ": expected fingerprint " + want + " but it presented " + key.Type() + " " + got +
+				". The server's key changed or the connection is being intercepted, refusing to connect")
+		}
+		return nil
+	}
+}
+
+// addKnownHost records a key seen for the first time, the trust on first use
+// of hostKeyCheck: accept-new
+func addKnownHost(file, hostname string, remote net.Addr, key ssh.PublicKey) error {
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.New("couldn't record host key of " + hostname + " in " + file + ": " + err.Error())
+	}
+	defer f.Close()
+	addresses := []string{knownhosts.Normalize(hostname)}
+	if remote != nil && knownhosts.Normalize(remote.String()) != addresses[0] {
+		addresses = append(addresses, knownhosts.Normalize(remote.String()))
+	}
+	if _, err := f.WriteString(knownhosts.Line(addresses, key) + "\n"); err != nil {
+		return err
+	}
+	logger.Info("Added host key of " + hostname + " (" + key.Type() + " " + ssh.FingerprintSHA256(key) + ") to " + file)
+	return nil
+}
+
+// knownHostAlgorithms asks the known_hosts callback which keys it has for the
+// address by offering it a throwaway key
+func knownHostAlgorithms(known ssh.HostKeyCallback, address string) []string {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil
+	}
+	probe, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		return nil
+	}
+	var keyErr *knownhosts.KeyError
+	if !errors.As(known(address, &net.TCPAddr{}, probe.PublicKey()), &keyErr) {
+		return nil
+	}
+	var algorithms []string
+	for _, k := range keyErr.Want {
+		switch k.Key.Type() {
+		case ssh.KeyAlgoRSA:
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+		default:
+			algorithms = append(algorithms, k.Key.Type())
+		}
+	}
+	return algorithms
+}
+
+// sshOptions passes the target's host key settings to the ssh and rsync
+// subprocesses. A pinned fingerprint can't be given to ssh, so the key is
+// fetched and checked first and ssh gets a known_hosts file with only that key.
+// The returned func removes that file.
+func sshOptions(target config.Target) ([]string, func(), error) {
+	noop := func() {}
+	if target.HostKeyFingerprint != "" {
+		key, err := fetchHostKey(target)
+		if err != nil {
+			return nil, noop, err
+		}
+		tmp, err := os.CreateTemp("", "monodb-known-hosts-*")
+		if err != nil {
+			return nil, noop, err
+		}
+		cleanup := func() { os.Remove(tmp.Name()) }
+		_, err = tmp.WriteString(knownhosts.Line([]string{knownhosts.Normalize(sshAddress(target))}, key) + "\n")
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			cleanup()
+			return nil, noop, err
+		}
+		return []string{"-o", "StrictHostKeyChecking=yes", "-o", "UserKnownHostsFile=" + tmp.Name(), "-o", "GlobalKnownHostsFile=/dev/null"}, cleanup, nil
+	}
+	check := target.HostKeyCheck
+	switch check {
+	case "":
+		check = "yes"
+	case "yes", "accept-new":
+	case "no":
+		logger.Info("Host key verification is disabled for " + target.Host)
+		return []string{"-o", "StrictHostKeyChecking=no", "-o", "UserKnownHostsFile=/dev/null"}, noop, nil
+	default:
+		return nil, noop, errors.New("unknown hostKeyCheck " + target.HostKeyCheck + " for " + target.Host + ", expected yes, accept-new or no")
+	}
+	return []string{"-o", "StrictHostKeyChecking=" + check, "-o", "UserKnownHostsFile=" + knownHostsFile(target)}, noop, nil
+}
+
+// errHostKeyFetched ends the handshake once the host key has been checked
+var errHostKeyFetched = errors.New("host key fetched")
+
+func fetchHostKey(target config.Target) (ssh.PublicKey, error) {
+	var key ssh.PublicKey
+	verify := pinnedHostKey(target)
+	config := &ssh.ClientConfig{
+		User: target.User,
+		HostKeyCallback: func(hostname string, remote net.Addr, k ssh.PublicKey) error {
+			if err := verify(hostname, remote, k); err != nil {
+				return err
+			}
+			key = k
+			return errHostKeyFetched
+		},
+	}
+	client, err := ssh.Dial("tcp", sshAddress(target), config)
+	if client != nil {
+		client.Close()
+	}
+	if key != nil {
+		return key, nil
+	}
+	if err == nil {
+		err = errors.New("no host key received from " + target.Host)
+	}
+	logger.Error("Couldn't verify the host key of " + target.Host + " - Error: " + err.Error())
+	return nil, err
+}
+
+// sshCommand is the -e argument of rsync. rsync splits it itself instead of
+// a shell, quotes keep spaces in an option but a single quote can't be
+// escaped the way a shell would take it, so options with one are refused.
+func sshCommand(options []string) (string, error) {
+	command := "ssh"
+	for _, o := range options {
+		if strings.Contains(o, "'") {
+			return "", errors.New("ssh option " + o + " contains a single quote, which can't be passed to rsync's remote shell")
+		}
+		command += " '" + o + "'"
+	}
+	return command, nil
+}
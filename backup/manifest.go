@@ -0,0 +1,109 @@
+package backup
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Version is recorded in every manifest, main sets it at startup
+var Version = "dev"
+
+const manifestSuffix = ".manifest.json"
+const checksumSuffix = ".sha256"
+
+// sidecarSuffixes lists the small files that are stored next to an artifact.
+// Retention never counts them as backups and deletes them with their artifact.
+var sidecarSuffixes = []string{manifestSuffix, checksumSuffix}
+
+// manifest describes how an artifact was produced so that it can be restored
+// without guessing from its name.
+type manifest struct {
+	Version   string    `json:"version"`
+	Engine    string    `json:"engine"`
+	Database  string    `json:"database"`
+	Host      string    `json:"host"`
+	Artifact  string    `json:"artifact"`
+	Codec     string    `json:"codec"`
+	Level     *int      `json:"level,omitempty"`
+	Encrypted bool      `json:"encrypted"`
+	Cipher    string    `json:"cipher,omitempty"`
+	Size      int64     `json:"size,omitempty"`
+	SHA256    string    `json:"sha256,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	WALStart  string    `json:"walStart,omitempty"` // first WAL segment a base backup needs
+}
+
+type sidecar struct {
+	suffix string
+	data   []byte
+}
+
+func engineName() string {
+	if params.Database == "" {
+		return "postgresql"
+	}
+	return params.Database
+}
+
+func newManifest(db, name string) *manifest {
+	parts := strings.Split(name, "/")
+	m := &manifest{
+		Version:   Version,
+		Engine:    engineName(),
+		Database:  db,
+		Host:      params.Fqdn,
+		Artifact:  parts[len(parts)-1],
+		Codec:     compressionCodec(),
+		Encrypted: encryptionEnabled(),
+		CreatedAt: time.Now(),
+	}
+	if m.Codec != "none" {
+		m.Level = params.Compression.Level
+	}
+	m.Cipher = encryptionMode()
+	if db == pgBaseBackup {
+		m.WALStart = baseBackupWALStart
+	}
+	return m
+}
+
+// sidecars returns the files to store next to the artifact at path, which
+// may be a rotation copy with a different name than the original.
+func (m *manifest) sidecars(path string) []sidecar {
+	if m == nil {
+		return nil
+	}
+	parts := strings.Split(path, "/")
+	copied := *m
+	copied.Artifact = parts[len(parts)-1]
+	data, err := json.MarshalIndent(copied, "", "  ")
+	if err != nil {
+		logger.Error("Couldn't encode manifest of " + m.Artifact + " - Error: " + err.Error())
+		return nil
+	}
+	sidecars := []sidecar{{suffix: manifestSuffix, data: data}}
+	if m.SHA256 != "" {
+		// same format as sha256sum, so `sha256sum -c` works on downloaded backups
+		sidecars = append(sidecars, sidecar{suffix: checksumSuffix, data: []byte(m.SHA256 + "  " + copied.Artifact + "\n")})
+	}
+	return sidecars
+}
+
+func isSidecar(name string) bool {
+	for _, suffix := range sidecarSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func sidecarOwner(name string) string {
+	for _, suffix := range sidecarSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix)
+		}
+	}
+	return name
+}
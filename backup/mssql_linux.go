@@ -76,7 +76,7 @@ func getMSSQLList() []string {
 
 func dumpMSSQLDB(dbName, dst string) (string, string, error) {
 	var name string
-	encrypted := params.ArchivePass != ""
+	encrypted := encryptionEnabled()
 
 	logger.Info("MSSQL backup started. DB: " + dbName + " - Encrypted: " + strconv.FormatBool(encrypted))
 	name = dumpName(dbName, params.Rotation, "") + ".bak"
@@ -104,5 +104,13 @@ func dumpMSSQLDB(dbName, dst string) (string, string, error) {
 		logger.Error("Couldn't back up database: " + dbName + " - Error: " + err.Error())
 		return "", "", err
 	}
+	if encrypted {
+		dumpPath, err = encryptFile(dumpPath)
+		if err != nil {
+			logger.Error("Couldn't encrypt backup of database: " + dbName + " - Error: " + err.Error())
+			return "", "", err
+		}
+		name = name + encryptionExtension()
+	}
 	return dumpPath, name, nil
 }
@@ -149,30 +149,16 @@ func getTableList(dbName, path string) ([]string, string, error) {
 	return tableList, filename, nil
 }
 
-func dumpAndUploadMySQL(db string, pipeWriters []*io.PipeWriter) error {
-	encrypted := params.ArchivePass != ""
-	var format string
-	var stderr bytes.Buffer
+func dumpAndUploadMySQL(db string, w io.Writer) error {
+	encrypted := encryptionEnabled()
 	output := make([]byte, 100)
-	var writers []io.Writer
-	for _, pw := range pipeWriters {
-		writers = append(writers, pw)
-	}
 
 	mariadb, dumpCommandTMP := isCommandAvailable("mariadb-dump")
 	if mariadb {
 		dumpCommand = dumpCommandTMP
 	}
 
-	if encrypted {
-		format = "7zip"
-	} else if params.Format == "gzip" {
-		format = "gzip"
-	} else {
-		format = "7zip"
-	}
-
-	logger.Info("MySQL backup started. DB: " + db + " - Compression algorithm: " + format + " - Encrypted: " + strconv.FormatBool(encrypted))
+	logger.Info("MySQL backup started. DB: " + db + " - Compression algorithm: " + compressionCodec() + " - Encrypted: " + strconv.FormatBool(encrypted))
 
 	var mysqlArgs []string
 	if params.Remote.IsRemote {
@@ -204,20 +190,20 @@ func dumpAndUploadMySQL(db string, pipeWriters []*io.PipeWriter) error {
 		return err
 	}
 
-	cmd2 := exec.Command("gzip")
-	cmd2.Stdin = stdout
-
-	cmd2.Stdout = io.MultiWriter(writers...)
-	cmd2.Stderr = &stderr
-
-	err = cmd2.Start()
+	cw, err := newArtifactWriter(w)
 	if err != nil {
-		logger.Error("Couldn't compress " + db + " - Error: " + err.Error() + " - " + stderr.String())
+		cmd.Process.Kill()
+		cmd.Wait()
+		logger.Error("Couldn't compress " + db + " - Error: " + err.Error())
 		return err
 	}
-
-	err = cmd2.Wait()
+	_, err = io.Copy(cw, stdout)
+	if closeErr := cw.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
 		logger.Error("Couldn't compress " + db + " - Error: " + err.Error())
 		return err
 	}
@@ -273,17 +259,8 @@ func dumpDBWithTables(db, dst string) ([]string, []string, error) {
 
 func dumpTable(db, table, dst string) (string, string, error) {
 	var name string
-	encrypted := params.ArchivePass != ""
-	var format string
-	if encrypted {
-		format = "7zip"
-	} else if params.Format == "gzip" {
-		format = "gzip"
-	} else {
-		format = "7zip"
-	}
-
-	logger.Info("MySQL backup started. DB: " + db + " Table: " + table + " - Compression algorithm: " + format + " - Encrypted: " + strconv.FormatBool(encrypted))
+	encrypted := encryptionEnabled()
+	logger.Info("MySQL backup started. DB: " + db + " Table: " + table + " - Compression algorithm: " + compressionCodec() + " - Encrypted: " + strconv.FormatBool(encrypted))
 
 	var mysqlArgs []string
 	if params.Remote.IsRemote {
@@ -299,18 +276,9 @@ func dumpTable(db, table, dst string) (string, string, error) {
 
 func dumpMySQLDb(db, dst string) (string, string, error) {
 	var name string
-	encrypted := params.ArchivePass != ""
-	var format string
+	encrypted := encryptionEnabled()
 
-	if encrypted {
-		format = "7zip"
-	} else if params.Format == "gzip" {
-		format = "gzip"
-	} else {
-		format = "7zip"
-	}
-
-	logger.Info("MySQL backup started. DB: " + db + " - Compression algorithm: " + format + " - Encrypted: " + strconv.FormatBool(encrypted))
+	logger.Info("MySQL backup started. DB: " + db + " - Compression algorithm: " + compressionCodec() + " - Encrypted: " + strconv.FormatBool(encrypted))
 
 	var mysqlArgs []string
 	if params.Remote.IsRemote {
@@ -337,24 +305,13 @@ func dumpMySQLDb(db, dst string) (string, string, error) {
 
 func mysqlDump(db, name, dst string, encrypted bool, mysqlArgs []string) (string, string, error) {
 	var cmd *exec.Cmd
-	var cmd2 *exec.Cmd
-	var stderr bytes.Buffer
 	var mysqldumpStderr bytes.Buffer
-	var format string
 
 	mariadb, dumpCommandTMP := isCommandAvailable("mariadb-dump")
 	if mariadb {
 		dumpCommand = dumpCommandTMP
 	}
 
-	if encrypted {
-		format = "7zip"
-	} else if params.Format == "gzip" {
-		format = "gzip"
-	} else {
-		format = "7zip"
-	}
-
 	var dumpPath string
 	cmd = exec.Command(dumpCommand, mysqlArgs...)
 	stdout, err := cmd.StdoutPipe()
@@ -370,61 +327,21 @@ func mysqlDump(db, name, dst string, encrypted bool, mysqlArgs []string) (string
 		return "", "", err
 	}
 
-	if !encrypted && format == "gzip" {
-		name = name + ".sql.gz"
-		dumpPath = dst + "/" + name
-		cmd2 = exec.Command("gzip")
-		cmd2.Stdin = stdout
-
-		if err := os.MkdirAll(filepath.Dir(dumpPath), 0770); err != nil {
-			logger.Error("Couldn't create parent direectories at backup destination. dst: " + dst + " - Error: " + err.Error())
-			return "", "", err
-		}
-
-		f, err := os.Create(dumpPath)
-		if err != nil {
-			logger.Error("Couldn't back up " + db + " - Error: " + err.Error())
-			return "", "", err
-		}
-
-		defer func() {
-			err := f.Close()
-			if err != nil {
-				logger.Error("Couldn't close file " + f.Name() + " - Error: " + err.Error())
-			}
-		}()
-
-		cmd2.Stdout = f
-		cmd2.Stderr = &stderr
-
-		err = cmd2.Start()
-		if err != nil {
-			logger.Error("Couldn't compress " + db + " - Error: " + err.Error() + " - " + stderr.String())
-			return "", "", err
-		}
-
-		err = cmd2.Wait()
-		if err != nil {
-			logger.Error("Couldn't compress " + db + " - Error: " + err.Error())
-			return "", "", err
-		}
-	} else {
-		name = name + ".sql.7z"
-		dumpPath = dst + "/" + name
-		if encrypted {
-			cmd2 = exec.Command("7z", "a", "-t7z", "-ms=on", "-mhe=on", "-p"+params.ArchivePass, "-si", dumpPath)
-		} else {
-			cmd2 = exec.Command("7z", "a", "-t7z", "-ms=on", "-si", dumpPath)
-		}
-
-		cmd2.Stdin = stdout
-		cmd2.Stderr = &stderr
+	name = name + ".sql" + artifactExtension()
+	dumpPath = dst + "/" + name
+	if err := os.MkdirAll(filepath.Dir(dumpPath), 0770); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		logger.Error("Couldn't create parent direectories at backup destination. dst: " + dst + " - Error: " + err.Error())
+		return "", "", err
+	}
 
-		err = cmd2.Run()
-		if err != nil {
-			logger.Error("Couldn't compress " + db + " - Error: " + err.Error() + " - " + stderr.String())
-			return "", "", err
-		}
+	err = writeArtifact(stdout, dumpPath)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		logger.Error("Couldn't compress " + db + " - Error: " + err.Error())
+		return "", "", err
 	}
 	err = cmd.Wait()
 	if err != nil {
@@ -0,0 +1,253 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"golang.org/x/sync/semaphore"
+)
+
+// maxPartSize is the largest part S3 accepts
+const maxPartSize = 5 * 1024 * 1024 * 1024
+
+// estimateDumpSize asks the server how large db is. Returns 0 when it can't be
+// found out, streamed uploads use the configured part size then.
+func estimateDumpSize(db string) int64 {
+	var cmd *exec.Cmd
+	switch params.Database {
+	case "postgresql":
+		if db == pgGlobals {
+			// a few kilobytes of SQL
+			return 0
+		}
+		if db == pgBaseBackup {
+			cmd = exec.Command("/usr/bin/psql", "-Atc", "SELECT sum(pg_database_size(oid)) FROM pg_database", pgConnString("postgres"))
+			break
+		}
+		cmd = exec.Command("/usr/bin/psql", "-Atc", "SELECT pg_database_size(current_database())", pgConnString(db))
+	case "mysql":
+		mariadb, mysqlCommandTMP := isCommandAvailable("mariadb")
+		if mariadb {
+			mysqlCommand = mysqlCommandTMP
+		}
+		query := "SELECT COALESCE(SUM(data_length + index_length), 0) FROM information_schema.tables WHERE table_schema = '" + strings.ReplaceAll(db, "'", "''") + "'"
+		mysqlArgs := []string{"-N", "-B", "-e", query}
+		if params.Remote.IsRemote {
+			mysqlArgs = append(mysqlArgs, "-h"+params.Remote.Host, "--port="+params.Remote.Port, "-u"+params.Remote.User, "-p"+params.Remote.Password)
+		} else {
+			mysqlArgs = append(mysqlArgs, "-u"+params.Remote.User, "-p"+params.Remote.Password)
+		}
+		cmd = exec.Command(mysqlCommand, mysqlArgs...)
+	default:
+		return 0
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		logger.Error("Couldn't get the size of " + db + ", using the configured part size - Error: " + err.Error() + " " + strings.TrimSpace(stderr.String()))
+		return 0
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		logger.Error("Couldn't get the size of " + db + ", using the configured part size - Error: " + err.Error())
+		return 0
+	}
+	return size
+}
+
+// streamPartSize picks a part size that fits a dump of about estimate bytes
+// into S3's 10,000 parts. Dumps can be larger than the database on disk so
+// twice the estimate is planned for.
+func streamPartSize(partSize, estimate int64) int64 {
+	if need := (2*estimate + maxPartCount - 1) / maxPartCount; need > partSize {
+		const mb = 1024 * 1024
+		partSize = (need + mb - 1) / mb * mb
+	}
+	if partSize > maxPartSize {
+		partSize = maxPartSize
+	}
+	return partSize
+}
+
+// partGrowthInterval is the number of parts after which the parts of a
+// streamed upload double in size
+const partGrowthInterval = 1000
+
+// streamedPartSize is the size of a streamed upload's part partNumber
+func streamedPartSize(partSize int64, partNumber int32) int64 {
+	for i := int32(1); i <= (partNumber-1)/partGrowthInterval && partSize < maxPartSize; i++ {
+		partSize *= 2
+	}
+	return min(partSize, maxPartSize)
+}
+
+// streamCapacity is the most a streamed upload starting with partSize parts
+// can hold in maxPartCount parts
+func streamCapacity(partSize int64) int64 {
+	var capacity int64
+	for first := int32(1); first <= maxPartCount; first += partGrowthInterval {
+		capacity += streamedPartSize(partSize, first) * partGrowthInterval
+	}
+	return capacity
+}
+
+// uploadStreamToS3 uploads a dump while it is being written. Its parts start
+// at partSize and grow, so a dump larger than the estimate still fits into
+// maxPartCount parts instead of failing on the last one. Dumps smaller than a
+// part are sent with a single PutObject. At most partSize times the uploader's
+// concurrency is held in memory, fewer parts are sent at once as they grow.
+func uploadStreamToS3(ctx context.Context, s3Instance *uploaderStruct, input *s3.PutObjectInput, partSize int64) error {
+	body := input.Body
+	first := make([]byte, partSize)
+	n, err := io.ReadFull(body, first)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		input.Body = bytes.NewReader(first[:n])
+		input.ContentLength = aws.Int64(int64(n))
+		_, err := s3Instance.client.PutObject(ctx, input)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	key := aws.ToString(input.Key)
+	upload, err := s3Instance.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:                    input.Bucket,
+		Key:                       input.Key,
+		ChecksumAlgorithm:         input.ChecksumAlgorithm,
+		Metadata:                  input.Metadata,
+		Tagging:                   input.Tagging,
+		ServerSideEncryption:      input.ServerSideEncryption,
+		SSEKMSKeyId:               input.SSEKMSKeyId,
+		SSECustomerAlgorithm:      input.SSECustomerAlgorithm,
+		SSECustomerKey:            input.SSECustomerKey,
+		SSECustomerKeyMD5:         input.SSECustomerKeyMD5,
+		ObjectLockMode:            input.ObjectLockMode,
+		ObjectLockRetainUntilDate: input.ObjectLockRetainUntilDate,
+	})
+	if err != nil {
+		return err
+	}
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		parts    []types.CompletedPart
+		firstErr error
+	)
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr != nil
+	}
+	budget := partSize * int64(max(s3Instance.uploader.Concurrency, 1))
+	inFlight := semaphore.NewWeighted(budget)
+	// a part larger than the budget is sent on its own
+	weight := func(part []byte) int64 { return min(int64(cap(part)), budget) }
+	if err := inFlight.Acquire(ctx, weight(first)); err != nil {
+		fail(err)
+	}
+	part, last := first, false
+	for partNumber := int32(1); !failed(); partNumber++ {
+		wg.Add(1)
+		go func(partNumber int32, part []byte) {
+			defer wg.Done()
+			defer inFlight.Release(weight(part))
+			out, err := s3Instance.client.UploadPart(ctx, &s3.UploadPartInput{
+				Bucket:               input.Bucket,
+				Key:                  input.Key,
+				UploadId:             upload.UploadId,
+				PartNumber:           aws.Int32(partNumber),
+				Body:                 bytes.NewReader(part),
+				ContentLength:        aws.Int64(int64(len(part))),
+				ChecksumAlgorithm:    types.ChecksumAlgorithmSha256,
+				SSECustomerAlgorithm: input.SSECustomerAlgorithm,
+				SSECustomerKey:       input.SSECustomerKey,
+				SSECustomerKeyMD5:    input.SSECustomerKeyMD5,
+			})
+			if err != nil {
+				fail(err)
+				return
+			}
+			mu.Lock()
+			parts = append(parts, types.CompletedPart{
+				ETag:           out.ETag,
+				ChecksumSHA256: out.ChecksumSHA256,
+				PartNumber:     aws.Int32(partNumber),
+			})
+			mu.Unlock()
+		}(partNumber, part)
+		if last {
+			break
+		}
+		if partNumber == maxPartCount {
+			fail(errors.New(key + " is larger than " + strconv.FormatInt(streamCapacity(partSize)/1024/1024, 10) + " MB, the most " + strconv.Itoa(maxPartCount) + " parts starting at " + strconv.FormatInt(partSize/1024/1024, 10) + " MB can hold. Increase partSize"))
+			break
+		}
+		size := streamedPartSize(partSize, partNumber+1)
+		if size != int64(len(part)) {
+			logger.Info(key + " has grown past " + strconv.Itoa(int(partNumber)) + " parts, continuing with " + strconv.FormatInt(size/1024/1024, 10) + " MB parts")
+		}
+		if err := inFlight.Acquire(ctx, min(size, budget)); err != nil {
+			fail(err)
+			break
+		}
+		part = make([]byte, size)
+		n, err := io.ReadFull(body, part)
+		if err == io.EOF {
+			inFlight.Release(weight(part))
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			part, last = part[:n], true
+		} else if err != nil {
+			inFlight.Release(weight(part))
+			fail(err)
+			break
+		}
+	}
+	wg.Wait()
+
+	if firstErr == nil {
+		sort.Slice(parts, func(i, j int) bool { return *parts[i].PartNumber < *parts[j].PartNumber })
+		_, firstErr = s3Instance.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:               input.Bucket,
+			Key:                  input.Key,
+			UploadId:             upload.UploadId,
+			MultipartUpload:      &types.CompletedMultipartUpload{Parts: parts},
+			SSECustomerAlgorithm: input.SSECustomerAlgorithm,
+			SSECustomerKey:       input.SSECustomerKey,
+			SSECustomerKeyMD5:    input.SSECustomerKeyMD5,
+		})
+		if firstErr == nil {
+			return nil
+		}
+	}
+	_, err = s3Instance.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   input.Bucket,
+		Key:      input.Key,
+		UploadId: upload.UploadId,
+	})
+	if err != nil {
+		logger.Error("Couldn't abort the upload of " + key + "\nBucket: " + aws.ToString(input.Bucket) + "\n Error: " + err.Error())
+	}
+	return firstErr
+}
@@ -0,0 +1,65 @@
+package backup
+
+import "testing"
+
+const mb = 1024 * 1024
+
+func TestStreamPartSize(t *testing.T) {
+	tests := []struct {
+		name     string
+		partSize int64
+		estimate int64
+		want     int64
+	}{
+		{"unknown size", 5 * mb, 0, 5 * mb},
+		{"fits the configured size", 5 * mb, 10 * 1024 * mb, 5 * mb},
+		{"rounded up to a megabyte", 5 * mb, 100 * 1024 * mb, 21 * mb},
+		{"larger configured size is kept", 64 * mb, 100 * 1024 * mb, 64 * mb},
+		{"capped at the largest part", 5 * mb, 40 * 1024 * 1024 * mb, maxPartSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := streamPartSize(tt.partSize, tt.estimate); got != tt.want {
+				t.Errorf("streamPartSize(%d, %d) = %d, want %d", tt.partSize, tt.estimate, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamedPartSize(t *testing.T) {
+	tests := []struct {
+		partSize   int64
+		partNumber int32
+		want       int64
+	}{
+		{5 * mb, 1, 5 * mb},
+		{5 * mb, partGrowthInterval, 5 * mb},
+		{5 * mb, partGrowthInterval + 1, 10 * mb},
+		{5 * mb, 2*partGrowthInterval + 1, 20 * mb},
+		{5 * mb, maxPartCount, 5 * mb << 9},
+		{maxPartSize / 2, partGrowthInterval + 1, maxPartSize},
+		{maxPartSize / 2, maxPartCount, maxPartSize},
+		{maxPartSize, 1, maxPartSize},
+	}
+	for _, tt := range tests {
+		if got := streamedPartSize(tt.partSize, tt.partNumber); got != tt.want {
+			t.Errorf("streamedPartSize(%d, %d) = %d, want %d", tt.partSize, tt.partNumber, got, tt.want)
+		}
+	}
+}
+
+func TestStreamCapacity(t *testing.T) {
+	if got, want := streamCapacity(5*mb), int64(5*mb*partGrowthInterval*(1<<10-1)); got != want {
+		t.Errorf("streamCapacity(5 MB) = %d, want %d", got, want)
+	}
+	if got, want := streamCapacity(maxPartSize), int64(maxPartSize*maxPartCount); got != want {
+		t.Errorf("streamCapacity(maxPartSize) = %d, want %d", got, want)
+	}
+	// the planned part size leaves room for a dump twice the estimate
+	for _, estimate := range []int64{0, mb, 1024 * mb, 100 * 1024 * mb, 10 * 1024 * 1024 * mb} {
+		partSize := streamPartSize(5*mb, estimate)
+		if capacity := streamCapacity(partSize); capacity < 2*estimate {
+			t.Errorf("estimate %d: capacity %d of %d byte parts is less than twice the estimate", estimate, capacity, partSize)
+		}
+	}
+}
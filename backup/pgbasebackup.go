@@ -0,0 +1,229 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// pgBaseBackup is the name physical backups of the cluster are stored under,
+// as if it were a database
+const pgBaseBackup = "pg_basebackup"
+
+func pgPhysical() bool {
+	return params.PostgreSQL.Mode == "physical"
+}
+
+// dumpPSQLBaseBackup takes a base backup of the cluster with pg_basebackup
+// in tar format, with the WAL needed to make it consistent streamed next to
+// it and a manifest with SHA-256 checksums. It is checked with
+// pg_verifybackup, then its directory (base.tar, pg_wal.tar, a tar for each
+// tablespace and backup_manifest) is written to w as a tar archive.
+// pg_basebackup can only write to a stream without WAL streaming.
+func dumpPSQLBaseBackup(w io.Writer) error {
+	var stderr bytes.Buffer
+	if err := os.MkdirAll(params.BackupDestination, 0770); err != nil {
+		return err
+	}
+	baseBackupWALStart = ""
+	if err := checkBaseBackupSpace(); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(params.BackupDestination, ".pg_basebackup-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, "backup")
+	args := []string{"-d", pgConnString("postgres"), "-D", dir, "-Ft", "-X", "stream", "--manifest-checksums=SHA256", "-l", "monodb-backup " + dateNow.now}
+	if compressionCodec() == "none" {
+		// compressed by monodb-backup otherwise
+		args = append(args, "-z")
+	}
+	switch params.PostgreSQL.Checkpoint {
+	case "":
+	case "fast", "spread":
+		args = append(args, "-c", params.PostgreSQL.Checkpoint)
+	default:
+		return errors.New("unknown checkpoint " + params.PostgreSQL.Checkpoint + ", expected fast or spread")
+	}
+	logger.Info("pg_basebackup started, the backup is written to " + dir + " before it is archived")
+	cmd := exec.Command("/usr/bin/pg_basebackup", args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return errors.New(err.Error() + " - " + stderr.String())
+	}
+	if err := verifyPSQLBaseBackup(dir, tmp); err != nil {
+		return errors.New("pg_verifybackup failed - " + err.Error())
+	}
+	baseBackupWALStart, err = readWALStart(dir)
+	if err != nil {
+		// the archived WAL is kept then, it can't be told what this backup needs
+		logger.Error("Couldn't find the start of the base backup's WAL - Error: " + err.Error())
+	}
+	return tarDirectory(dir, w)
+}
+
+// checkBaseBackupSpace fails before pg_basebackup starts when
+// backupDestination can't hold the backup while it is staged there, twice
+// the cluster's size below PostgreSQL 18 where it is extracted to be verified
+func checkBaseBackupSpace() error {
+	size := estimateDumpSize(pgBaseBackup)
+	if size == 0 {
+		return nil
+	}
+	need := size
+	if major, err := pgToolMajor("/usr/bin/pg_verifybackup"); err == nil && major < 18 {
+		need *= 2
+	}
+	free, err := freeSpace(params.BackupDestination)
+	if err != nil {
+		logger.Error("Couldn't get the free space of " + params.BackupDestination + " - Error: " + err.Error())
+		return nil
+	}
+	if free < need {
+		return errors.New(params.BackupDestination + " has " + strconv.FormatInt(free/1024/1024, 10) + " MB free, the base backup of a " + strconv.FormatInt(size/1024/1024, 10) + " MB cluster needs " + strconv.FormatInt(need/1024/1024, 10) + " MB there")
+	}
+	return nil
+}
+
+// verifyPSQLBaseBackup checks a tar format base backup against its manifest.
+// pg_verifybackup reads tar format backups since PostgreSQL 18, for older
+// versions the backup is extracted under scratch first, which takes as much
+// room as the cluster.
+func verifyPSQLBaseBackup(dir, scratch string) error {
+	major, err := pgToolMajor("/usr/bin/pg_verifybackup")
+	if err != nil {
+		return err
+	}
+	if major >= 18 {
+		return runVerifyBackup(dir)
+	}
+	dataDir := filepath.Join(scratch, "verify")
+	defer os.RemoveAll(dataDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		f, err := os.Open(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		err = extractBaseBackupFile(entry.Name(), f, dataDir)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return runVerifyBackup(dataDir)
+}
+
+func runVerifyBackup(dir string) error {
+	var stderr, stdout bytes.Buffer
+	cmd := exec.Command("/usr/bin/pg_verifybackup", dir)
+	cmd.Stderr = &stderr
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return errors.New(err.Error() + " - " + strings.TrimSpace(stderr.String()))
+	}
+	logger.Info(strings.TrimSpace(stdout.String()))
+	return nil
+}
+
+var pgVersion = regexp.MustCompile(`\(PostgreSQL\) (\d+)`)
+
+// pgToolMajor returns the major version of a PostgreSQL client program
+func pgToolMajor(path string) (int, error) {
+	out, err := exec.Command(path, "--version").Output()
+	if err != nil {
+		return 0, err
+	}
+	match := pgVersion.FindSubmatch(out)
+	if match == nil {
+		return 0, errors.New("couldn't find the version in " + strings.TrimSpace(string(out)))
+	}
+	return strconv.Atoi(string(match[1]))
+}
+
+// extractBaseBackupFile extracts one file of a tar format base backup into a
+// data directory: base.tar into the directory itself, pg_wal.tar into pg_wal
+// and the tar of each tablespace into pg_tblspc/<oid>, as an in-place
+// tablespace instead of a link to its original location.
+func extractBaseBackupFile(name string, r io.Reader, dataDir string) error {
+	if name == "backup_manifest" {
+		if err := os.MkdirAll(dataDir, 0700); err != nil {
+			return err
+		}
+		return writeFile(r, filepath.Join(dataDir, name))
+	}
+	if strings.HasSuffix(name, ".gz") {
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		r = gr
+		name = strings.TrimSuffix(name, ".gz")
+	}
+	if !strings.HasSuffix(name, ".tar") {
+		return errors.New("unexpected file " + name + " in the base backup")
+	}
+	switch base := strings.TrimSuffix(name, ".tar"); base {
+	case "base":
+		return untar(r, dataDir)
+	case "pg_wal":
+		return untar(r, filepath.Join(dataDir, "pg_wal"))
+	default:
+		if _, err := strconv.Atoi(base); err != nil {
+			return errors.New("unexpected file " + name + " in the base backup")
+		}
+		return untar(r, filepath.Join(dataDir, "pg_tblspc", base))
+	}
+}
+
+func isPSQLBaseBackup(name string) bool {
+	return strings.HasPrefix(filepath.Base(name), pgBaseBackup+"-") && strings.HasSuffix(name, ".tar")
+}
+
+// restorePSQLBaseBackup extracts a base backup into an empty data directory
+// and checks it with pg_verifybackup. Starting PostgreSQL on the directory
+// then replays the WAL in the backup up to the point it was taken.
+func restorePSQLBaseBackup(r io.Reader, dataDir string) error {
+	entries, err := os.ReadDir(dataDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(entries) > 0 {
+		return errors.New(dataDir + " is not empty, base backups are only restored into an empty data directory")
+	}
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return err
+	}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		logger.Info("Extracting " + header.Name + " into " + dataDir)
+		if err := extractBaseBackupFile(header.Name, tr, dataDir); err != nil {
+			return err
+		}
+	}
+	return runVerifyBackup(dataDir)
+}
@@ -2,6 +2,7 @@ package backup
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"monodb-backup/config"
 	"monodb-backup/notify"
@@ -13,6 +14,9 @@ import (
 )
 
 func getPSQLList() []string {
+	if pgPhysical() {
+		return []string{pgBaseBackup}
+	}
 	var remote config.Remote = params.Remote
 	psqlArgs := []string{"-lqt"}
 	var stderr bytes.Buffer
@@ -48,35 +52,175 @@ func getPSQLList() []string {
 	return dbList
 }
 
-func dumpAndUploadPSQL(db string, pipeWriters []*io.PipeWriter) error {
-	var cmd *exec.Cmd
-	var stderr bytes.Buffer
-	var remote config.Remote = params.Remote
-	var writers []io.Writer
-	for _, pw := range pipeWriters {
-		writers = append(writers, pw)
+// pgConnString returns the database name for local servers and a connection
+// URI for remote ones, as accepted by pg_dump -d and pg_restore -d.
+func pgConnString(db string) string {
+	remote := params.Remote
+	if !remote.IsRemote {
+		return db
 	}
+	if remote.Port != "" {
+		return "postgresql://" + remote.User + ":" + remote.Password + "@" + remote.Host + ":" + remote.Port + "/" + db
+	}
+	return "postgresql://" + remote.User + ":" + remote.Password + "@" + remote.Host + "/" + db
+}
 
-	var pgDumpArgs []string
-	if remote.IsRemote {
-		var pglink string
-		if remote.Port != "" {
-			pglink = "postgresql://" + remote.User + ":" + remote.Password + "@" + remote.Host + ":" + remote.Port + "/" + db
-		} else {
-			pglink = "postgresql://" + remote.User + ":" + remote.Password + "@" + remote.Host + "/" + db
+// pgGlobals is the name the cluster's roles, tablespaces and grants are backed
+// up under, as if it were a database
+const pgGlobals = "pg_globals"
+
+// psqlDatabases returns what is backed up in a run: the base backup of the
+// cluster in physical mode, otherwise the databases with the globals first if
+// they are to be backed up, so that they are restored before the databases
+// using them
+func psqlDatabases(databases []string) []string {
+	if params.Database != "" && params.Database != "postgresql" {
+		return databases
+	}
+	if pgPhysical() {
+		return []string{pgBaseBackup}
+	}
+	if !params.PostgreSQL.Globals {
+		return databases
+	}
+	for _, db := range databases {
+		if db == pgGlobals {
+			return databases
 		}
-		pgDumpArgs = append(pgDumpArgs, pglink)
-	} else {
-		pgDumpArgs = append(pgDumpArgs, db)
 	}
+	return append([]string{pgGlobals}, databases...)
+}
+
+// pgDumpCommand runs pg_dump for a database and pg_dumpall --globals-only
+// for pgGlobals
+func pgDumpCommand(db string, args ...string) *exec.Cmd {
+	if db == pgGlobals {
+		dumpallArgs := []string{"--globals-only", "-d", pgConnString("postgres")}
+		if params.PostgreSQL.NoRolePasswords {
+			dumpallArgs = append(dumpallArgs, "--no-role-passwords")
+		}
+		return exec.Command("/usr/bin/pg_dumpall", append(dumpallArgs, args...)...)
+	}
+	pgDumpArgs := append([]string{pgConnString(db)}, pgDumpFormatArgs()...)
+	return exec.Command("/usr/bin/pg_dump", append(pgDumpArgs, args...)...)
+}
+
+// pgDumpExtension is .sql for the globals, which are plain SQL for psql, .tar
+// for base backups and directory format dumps and .dump for pg_restore
+// archives
+func pgDumpExtension(db string) string {
+	if db == pgGlobals {
+		return ".sql"
+	}
+	if format, _ := pgDumpFormat(db); format == "directory" || db == pgBaseBackup {
+		return ".tar"
+	}
+	return ".dump"
+}
 
-	pgDumpArgs = append(pgDumpArgs, "-Fc")
+// pgDumpFormat returns the pg_dump format of db, custom or directory, and the
+// number of parallel jobs for the directory format
+func pgDumpFormat(db string) (string, int) {
+	format, jobs := params.PostgreSQL.Format, params.PostgreSQL.Jobs
+	for _, d := range params.PostgreSQL.PerDatabase {
+		if d.Name != db {
+			continue
+		}
+		if d.Format != "" {
+			format = d.Format
+		}
+		if d.Jobs != 0 {
+			jobs = d.Jobs
+		}
+	}
+	if format == "" {
+		format = "custom"
+	}
+	if jobs <= 0 {
+		jobs = 4
+	}
+	return format, jobs
+}
+
+// pgTarDump returns the function writing db as a tar archive for base backups
+// and directory format dumps, nil for the archives pg_dump writes itself
+func pgTarDump(db string) (func(io.Writer) error, error) {
+	if db == pgGlobals {
+		return nil, nil
+	}
+	if db == pgBaseBackup {
+		return dumpPSQLBaseBackup, nil
+	}
+	format, jobs := pgDumpFormat(db)
+	switch format {
+	case "custom":
+		return nil, nil
+	case "directory":
+		return func(w io.Writer) error {
+			return dumpPSQLDirectory(db, jobs, w)
+		}, nil
+	}
+	return nil, errors.New("unknown PostgreSQL format " + format + ", expected custom or directory")
+}
+
+// dumpPSQLDirectory dumps db with pg_dump -Fd -j into a temporary directory
+// under the backup destination, then writes the directory to w as a tar
+// archive. pg_dump can't write the directory format to a stream itself.
+func dumpPSQLDirectory(db string, jobs int, w io.Writer) error {
+	var stderr bytes.Buffer
+	if err := os.MkdirAll(params.BackupDestination, 0770); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(params.BackupDestination, ".pg_dump-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, "dump")
+	args := []string{pgConnString(db), "-Fd", "-j", strconv.Itoa(jobs), "-f", dir}
+	if compressionCodec() != "none" {
+		args = append(args, "-Z0")
+	}
+	cmd := exec.Command("/usr/bin/pg_dump", args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return errors.New(err.Error() + " - " + stderr.String())
+	}
+	return tarDirectory(dir, w)
+}
+
+func dumpAndUploadPSQL(db string, w io.Writer) error {
+	var cmd *exec.Cmd
+	var stderr bytes.Buffer
 
-	cmd = exec.Command("/usr/bin/pg_dump", pgDumpArgs...)
-	// cmd.Stdout = pipeWriter
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = io.MultiWriter(writers...)
-	err := cmd.Run()
+	cw, err := newArtifactWriter(w)
+	if err != nil {
+		logger.Error("Couldn't back up " + db + " - Error: " + err.Error())
+		return err
+	}
+	tarDump, err := pgTarDump(db)
+	if err != nil {
+		cw.Close()
+		logger.Error("Couldn't back up " + db + " - Error: " + err.Error())
+		return err
+	}
+	if tarDump != nil {
+		err = tarDump(cw)
+		if closeErr := cw.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			logger.Error("Couldn't back up " + db + " - Error: " + err.Error())
+		}
+		return err
+	}
+	cmd = pgDumpCommand(db)
+	cmd.Stderr = &stderr
+	cmd.Stdout = cw
+	err = cmd.Run()
+	if closeErr := cw.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
 		logger.Error("Couldn't back up " + db + " - Error: " + err.Error() + " - " + stderr.String())
 		return err
@@ -84,102 +228,83 @@ func dumpAndUploadPSQL(db string, pipeWriters []*io.PipeWriter) error {
 	return nil
 }
 
+// pgDumpFormatArgs disables pg_dump's own compression when the stream is
+// compressed by monodb-backup.
+func pgDumpFormatArgs() []string {
+	if compressionCodec() == "none" {
+		return []string{"-Fc"}
+	}
+	return []string{"-Fc", "-Z0"}
+}
+
 func dumpPSQLDb(db string, dst string) (string, string, error) {
-	encrypted := params.ArchivePass != ""
+	encrypted := encryptionEnabled()
 	var dumpPath string
-	var format string
 	var cmd *exec.Cmd
 	var stderr bytes.Buffer
-	var stderr1 bytes.Buffer
-	var remote config.Remote = params.Remote
 
 	name := dumpName(db, params.Rotation, "")
 
-	if params.Format == "7zip" {
-		format = "7zip"
-	} else {
-		format = "gzip"
-	}
-	logger.Info("PostgreSQL backup started. DB: " + db + " - Compression algorithm: " + format + " - Encrypted: " + strconv.FormatBool(encrypted))
+	logger.Info("PostgreSQL backup started. DB: " + db + " - Compression algorithm: " + compressionCodec() + " - Encrypted: " + strconv.FormatBool(encrypted))
 
-	var pgDumpArgs []string
-	if remote.IsRemote {
-		var pglink string
-		if remote.Port != "" {
-			pglink = "postgresql://" + remote.User + ":" + remote.Password + "@" + remote.Host + ":" + remote.Port + "/" + db
-		} else {
-			pglink = "postgresql://" + remote.User + ":" + remote.Password + "@" + remote.Host + "/" + db
-		}
-		pgDumpArgs = append(pgDumpArgs, pglink)
-	} else {
-		pgDumpArgs = append(pgDumpArgs, db)
-	}
 	if err := os.MkdirAll(filepath.Dir(dst+"/"+name), 0770); err != nil {
 		logger.Error("Couldn't create parent directories at backup destination. Name: " + name + " - Error: " + err.Error())
 		return "", "", err
 	}
 
-	if !encrypted {
-		name = name + ".dump"
-		dumpPath = dst + "/" + name
-		pgDumpArgs = append(pgDumpArgs, "-Fc", "-f", dumpPath)
-		cmd = exec.Command("/usr/bin/pg_dump", pgDumpArgs...)
-		cmd.Stderr = &stderr1
+	name = name + pgDumpExtension(db) + artifactExtension()
+	dumpPath = dst + "/" + name
+	tarDump, err := pgTarDump(db)
+	if err != nil {
+		logger.Error("Couldn't back up " + db + " - Error: " + err.Error())
+		return "", "", err
+	}
+	if tarDump != nil {
+		pr, pw := io.Pipe()
+		done := make(chan struct{})
+		go func() {
+			pw.CloseWithError(tarDump(pw))
+			close(done)
+		}()
+		err := writeArtifact(pr, dumpPath)
+		pr.CloseWithError(err)
+		<-done
+		if err != nil {
+			logger.Error("Couldn't back up " + db + " - Error: " + err.Error())
+			return "", "", err
+		}
+	} else if compressionCodec() == "none" && !encrypted {
+		cmd = pgDumpCommand(db, "-f", dumpPath)
+		cmd.Stderr = &stderr
 		err := cmd.Run()
 		if err != nil {
-			logger.Error("Couldn't back up " + db + " - Error: " + err.Error() + " - " + stderr1.String())
+			logger.Error("Couldn't back up " + db + " - Error: " + err.Error() + " - " + stderr.String())
 			return "", "", err
 		}
 	} else {
-		if format == "gzip" {
-			name = name + ".dump.7z"
-			dumpPath = dst + "/" + name
-			pgDumpArgs = append(pgDumpArgs, "-Fc")
-			cmd = exec.Command("/usr/bin/pg_dump", pgDumpArgs...)
-			stdout, err := cmd.StdoutPipe()
-			if err != nil {
-				logger.Error("Couldn't back up " + db + " - Error: " + err.Error())
-				return "", "", err
-			}
-			cmd.Stderr = &stderr1
-			err = cmd.Start()
-			if err != nil {
-				logger.Error("Couldn't back up " + db + " - Error: " + err.Error() + " - " + stderr1.String())
-				return "", "", err
-			}
-			cmd2 := exec.Command("7z", "a", "-t7z", "-mx0", "-mhe=on", "-p"+params.ArchivePass, "-si", dumpPath)
-			cmd2.Stdin = stdout
-			cmd2.Stderr = &stderr
-
-			err = cmd2.Run()
-			if err != nil {
-				logger.Error("Couldn't back up " + db + err.Error() + " - " + stderr.String())
-				return "", "", err
-			}
-		} else if format == "7zip" {
-			name = name + ".sql.7z"
-			dumpPath = dst + "/" + name
-			cmd = exec.Command("/usr/bin/pg_dump", pgDumpArgs...)
-			stdout, err := cmd.StdoutPipe()
-			if err != nil {
-				logger.Error("Couldn't back up " + db + " - Error: " + err.Error())
-				return "", "", err
-			}
-			cmd.Stderr = &stderr1
-			err = cmd.Start()
-			if err != nil {
-				logger.Error("Couldn't back up " + db + " - Error: " + err.Error() + " - " + stderr1.String())
-				return "", "", err
-			}
-			cmd2 := exec.Command("7z", "a", "-t7z", "-ms=on", "-mhe=on", "-p"+params.ArchivePass, "-si", dumpPath)
-			cmd2.Stdin = stdout
-			cmd2.Stderr = &stderr
-
-			err = cmd2.Run()
-			if err != nil {
-				logger.Error("Couldn't back up " + db + " - Error: " + err.Error() + " - " + stderr.String())
-				return "", "", err
-			}
+		cmd = pgDumpCommand(db)
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			logger.Error("Couldn't back up " + db + " - Error: " + err.Error())
+			return "", "", err
+		}
+		cmd.Stderr = &stderr
+		err = cmd.Start()
+		if err != nil {
+			logger.Error("Couldn't back up " + db + " - Error: " + err.Error() + " - " + stderr.String())
+			return "", "", err
+		}
+		err = writeArtifact(stdout, dumpPath)
+		if err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			logger.Error("Couldn't compress " + db + " - Error: " + err.Error())
+			return "", "", err
+		}
+		err = cmd.Wait()
+		if err != nil {
+			logger.Error("Couldn't back up " + db + " - Error: " + err.Error() + " - " + stderr.String())
+			return "", "", err
 		}
 	}
 	logger.Info("Successfully backed up " + db + " at: " + dumpPath)
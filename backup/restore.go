@@ -0,0 +1,246 @@
+package backup
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type RestoreOptions struct {
+	Input    string // artifact created by monodb-backup
+	Output   string // write the decrypted and decompressed dump here instead of restoring it
+	Database string // database to restore into
+	Identity string // age identity, SSH private key or armored OpenPGP private key
+	Globals  string // PostgreSQL globals artifact applied before the dump, owners are kept then
+	Jobs     int    // parallel pg_restore jobs
+	DataDir  string // empty data directory to restore PostgreSQL base backups into
+	// recover the base backup with the archived WAL up to this time, or to
+	// the end of the archive for latest. Config is the configuration file
+	// restore-wal is run with.
+	TargetTime string
+	Config     string
+}
+
+// openArtifact returns the plain dump stored in an artifact along with the
+// artifact's name without its compression and encryption extensions.
+func openArtifact(path, identity string) (io.ReadCloser, string, error) {
+	if strings.HasSuffix(path, ".7z") {
+		// archivePass meant 7-Zip archives before age encryption
+		return nil, "", errors.New(path + " is a 7-Zip archive from an earlier version, extract it with `7z x " + path + "` using archivePass and restore the extracted dump")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	r, err := newDecryptor(f, path, identity)
+	if err != nil {
+		f.Close()
+		return nil, "", err
+	}
+	name := trimEncryptionExtension(path)
+	dr, err := newDecompressor(r, name)
+	if err != nil {
+		f.Close()
+		return nil, "", err
+	}
+	return &artifactReader{ReadCloser: dr, file: f}, trimCompressionExtension(name), nil
+}
+
+type artifactReader struct {
+	io.ReadCloser
+	file *os.File
+}
+
+func (a *artifactReader) Close() error {
+	err := a.ReadCloser.Close()
+	if closeErr := a.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func Restore(opts RestoreOptions) error {
+	r, name, err := openArtifact(opts.Input, opts.Identity)
+	if err != nil {
+		logger.Error("Couldn't open " + opts.Input + " - Error: " + err.Error())
+		return err
+	}
+	defer r.Close()
+
+	if opts.Output != "" {
+		out, err := os.Create(opts.Output)
+		if err != nil {
+			logger.Error("Couldn't create " + opts.Output + " - Error: " + err.Error())
+			return err
+		}
+		_, err = io.Copy(out, r)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			logger.Error("Couldn't decode " + opts.Input + " to " + opts.Output + " - Error: " + err.Error())
+			return err
+		}
+		logger.Info("Successfully decoded " + opts.Input + " to " + opts.Output)
+		return nil
+	}
+
+	if isPSQLBaseBackup(name) {
+		if opts.DataDir == "" {
+			return errors.New("a data directory is needed to restore the base backup " + opts.Input)
+		}
+		if err := restorePSQLBaseBackup(r, opts.DataDir); err != nil {
+			logger.Error("Couldn't restore " + opts.Input + " to " + opts.DataDir + " - Error: " + err.Error())
+			return err
+		}
+		if opts.TargetTime != "" {
+			if err := writeRecoveryConfig(opts.DataDir, opts.Config, opts.Identity, opts.TargetTime); err != nil {
+				logger.Error("Couldn't write the recovery settings to " + opts.DataDir + " - Error: " + err.Error())
+				return err
+			}
+			logger.Info("PostgreSQL will replay the archived WAL up to " + opts.TargetTime + " when it is started on " + opts.DataDir)
+		}
+		logger.Info("Successfully restored " + opts.Input + " to " + opts.DataDir + ". Make it owned by the postgres user and start PostgreSQL on it")
+		return nil
+	}
+
+	if isPSQLGlobals(name) {
+		if err := restorePSQLGlobals(r); err != nil {
+			logger.Error("Couldn't apply the globals in " + opts.Input + " - Error: " + err.Error())
+			return err
+		}
+		logger.Info("Successfully applied the globals in " + opts.Input)
+		return nil
+	}
+
+	if opts.Database == "" {
+		return errors.New("a target database is needed to restore " + opts.Input)
+	}
+	switch {
+	case strings.HasSuffix(name, ".dump"), strings.HasSuffix(name, ".tar"):
+		if opts.Globals != "" {
+			// roles have to exist before the objects they own are restored
+			err = Restore(RestoreOptions{Input: opts.Globals, Identity: opts.Identity})
+			if err != nil {
+				return err
+			}
+		}
+		err = restorePSQL(opts.Database, r, strings.HasSuffix(name, ".tar"), opts.Globals != "", opts.Jobs)
+	case strings.HasSuffix(name, ".sql"):
+		err = restoreMySQL(opts.Database, r)
+	default:
+		err = errors.New("don't know how to restore " + opts.Input + ", use -out to only decode it")
+	}
+	if err != nil {
+		logger.Error("Couldn't restore " + opts.Input + " to " + opts.Database + " - Error: " + err.Error())
+		return err
+	}
+	logger.Info("Successfully restored " + opts.Input + " to " + opts.Database)
+	return nil
+}
+
+// restorePSQL restores a pg_dump archive, or a directory format dump tarred
+// by monodb-backup. Without the globals the owners may not exist, so the
+// objects are owned by the restoring user instead. pg_restore can only run
+// jobs in parallel from a file, so the archive is written to one under the
+// backup destination first then.
+func restorePSQL(db string, r io.Reader, directory, keepOwners bool, jobs int) error {
+	var stderr bytes.Buffer
+	args := []string{"-d", pgConnString(db)}
+	if !keepOwners {
+		args = append(args, "--no-owner")
+	}
+	if jobs > 1 {
+		args = append(args, "-j", strconv.Itoa(jobs))
+	}
+	var stdin io.Reader
+	if directory || jobs > 1 {
+		if err := os.MkdirAll(params.BackupDestination, 0770); err != nil {
+			return err
+		}
+		tmp, err := os.MkdirTemp(params.BackupDestination, ".pg_restore-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		path := filepath.Join(tmp, "dump")
+		if directory {
+			err = untar(r, path)
+		} else {
+			err = writeFile(r, path)
+		}
+		if err != nil {
+			return err
+		}
+		args = append(args, path)
+	} else {
+		stdin = r
+	}
+	cmd := exec.Command("/usr/bin/pg_restore", args...)
+	cmd.Stdin = stdin
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return errors.New(err.Error() + " - " + stderr.String())
+	}
+	return nil
+}
+
+func writeFile(r io.Reader, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func isPSQLGlobals(name string) bool {
+	return strings.HasPrefix(filepath.Base(name), pgGlobals+"-") && strings.HasSuffix(name, ".sql")
+}
+
+// restorePSQLGlobals runs the output of pg_dumpall --globals-only with psql.
+// Roles that already exist, such as the one restoring, make psql complain
+// without stopping, those errors are only logged.
+func restorePSQLGlobals(r io.Reader) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command("/usr/bin/psql", "-X", "-q", "-d", pgConnString("postgres"), "-f", "-")
+	cmd.Stdin = r
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return errors.New(err.Error() + " - " + stderr.String())
+	}
+	if stderr.Len() > 0 {
+		logger.Info("psql reported while applying the globals: " + strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+func restoreMySQL(db string, r io.Reader) error {
+	var stderr bytes.Buffer
+	mariadb, mysqlCommandTMP := isCommandAvailable("mariadb")
+	if mariadb {
+		mysqlCommand = mysqlCommandTMP
+	}
+	var mysqlArgs []string
+	if params.Remote.IsRemote {
+		mysqlArgs = append(mysqlArgs, "-h"+params.Remote.Host, "--port="+params.Remote.Port, "-u"+params.Remote.User, "-p"+params.Remote.Password)
+	} else {
+		mysqlArgs = append(mysqlArgs, "-u"+params.Remote.User, "-p"+params.Remote.Password)
+	}
+	mysqlArgs = append(mysqlArgs, db)
+	cmd := exec.Command(mysqlCommand, mysqlArgs...)
+	cmd.Stdin = r
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return errors.New(err.Error() + " - " + stderr.String())
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"monodb-backup/config"
+	"monodb-backup/notify"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// uploadState is the progress of an upload of a local dump to one target,
+// kept in resume.stateDir until the upload completes
+type uploadState struct {
+	Kind      string    `json:"kind"` // s3, sftp, rsync or spool
+	Target    string    `json:"target"`
+	Key       string    `json:"key"` // object key or remote path
+	Source    string    `json:"source"`
+	Database  string    `json:"database"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"modTime"`
+	UploadID  string    `json:"uploadId,omitempty"`
+	PartSize  int64     `json:"partSize,omitempty"`
+	Offset    int64     `json:"offset,omitempty"`
+	StartedAt time.Time `json:"startedAt"`
+}
+
+func resumeEnabled() bool {
+	return params.Resume.StateDir != ""
+}
+
+func statePath(target, key string) string {
+	sum := sha256.Sum256([]byte(target + "|" + key))
+	return filepath.Join(params.Resume.StateDir, hex.EncodeToString(sum[:16])+".json")
+}
+
+// newUploadState starts tracking the upload of source, nil when resuming is
+// off or source can't be read
+func newUploadState(kind, target, key, source, db string) *uploadState {
+	if !resumeEnabled() {
+		return nil
+	}
+	info, err := os.Stat(source)
+	if err != nil {
+		return nil
+	}
+	return &uploadState{
+		Kind:      kind,
+		Target:    target,
+		Key:       key,
+		Source:    source,
+		Database:  db,
+		Size:      info.Size(),
+		ModTime:   info.ModTime(),
+		StartedAt: time.Now(),
+	}
+}
+
+// loadUploadState returns the saved progress of an earlier upload of source
+// to key, nil if there isn't one or source has changed since
+func loadUploadState(target, key, source string) *uploadState {
+	if !resumeEnabled() {
+		return nil
+	}
+	state := readUploadState(statePath(target, key))
+	if state == nil || state.Source != source || !state.sourceUnchanged() {
+		return nil
+	}
+	return state
+}
+
+func readUploadState(path string) *uploadState {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var state uploadState
+	if err := json.Unmarshal(data, &state); err != nil {
+		logger.Error("Couldn't read upload state " + path + " - Error: " + err.Error())
+		return nil
+	}
+	return &state
+}
+
+func (s *uploadState) sourceUnchanged() bool {
+	info, err := os.Stat(s.Source)
+	return err == nil && info.Size() == s.Size && info.ModTime().Equal(s.ModTime)
+}
+
+// save writes the state next to the others, a crash while writing leaves the
+// previous state in place
+func (s *uploadState) save() {
+	if s == nil {
+		return
+	}
+	if err := os.MkdirAll(params.Resume.StateDir, 0700); err != nil {
+		logger.Error("Couldn't create " + params.Resume.StateDir + " - Error: " + err.Error())
+		return
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return
+	}
+	path := statePath(s.Target, s.Key)
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		logger.Error("Couldn't save upload state " + path + " - Error: " + err.Error())
+		return
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		logger.Error("Couldn't save upload state " + path + " - Error: " + err.Error())
+	}
+}
+
+func (s *uploadState) remove() {
+	if s == nil {
+		return
+	}
+	if err := os.Remove(statePath(s.Target, s.Key)); err != nil && !os.IsNotExist(err) {
+		logger.Error("Couldn't remove upload state of " + s.Key + " - Error: " + err.Error())
+	}
+}
+
+// pendingUploads lists the unfinished uploads of db whose dumps are still
+// there to be resumed
+func pendingUploads(db string) []*uploadState {
+	if !resumeEnabled() {
+		return nil
+	}
+	paths, _ := filepath.Glob(filepath.Join(params.Resume.StateDir, "*.json"))
+	var states []*uploadState
+	for _, path := range paths {
+		state := readUploadState(path)
+		if state == nil || state.Database != db {
+			continue
+		}
+		if !state.sourceUnchanged() {
+			logger.Info("Dropping upload state of " + state.Key + ", " + state.Source + " has changed or is gone")
+			os.Remove(path)
+			continue
+		}
+		states = append(states, state)
+	}
+	return states
+}
+
+// savedUploadIDs returns the S3 upload IDs kept in upload states, whatever
+// their database
+func savedUploadIDs() map[string]bool {
+	ids := make(map[string]bool)
+	if !resumeEnabled() {
+		return ids
+	}
+	paths, _ := filepath.Glob(filepath.Join(params.Resume.StateDir, "*.json"))
+	for _, path := range paths {
+		if state := readUploadState(path); state != nil && state.UploadID != "" {
+			ids[state.UploadID] = true
+		}
+	}
+	return ids
+}
+
+// resumePendingUploads finishes the interrupted uploads of db, only to the
+// targets that didn't get them. Returns false if there was nothing to resume.
+func resumePendingUploads(db string) bool {
+	states := pendingUploads(db)
+	for _, state := range states {
+		logger.Info("Resuming upload of " + state.Source + " to " + state.Target + ":" + state.Key)
+		artifact := filepath.Base(state.Source)
+		if state.Kind == "spool" {
+			artifact = state.Key
+		}
+		m := newManifest(db, artifact)
+		var err error
+		m.SHA256, m.Size, err = hashFile(state.Source)
+		if err != nil {
+			logger.Error("Couldn't calculate the checksum of " + state.Source + " - Error: " + err.Error())
+			m = nil
+		}
+		switch state.Kind {
+		case "s3":
+			err = resumeS3Upload(state, m)
+		case "sftp":
+			err = resumeSFTPUpload(state, m)
+		case "rsync":
+			err = resumeRsyncUpload(state, m)
+		case "spool":
+			err = resumeSpoolUpload(state, m)
+		}
+		name := strings.TrimPrefix(state.Key, "/")
+		if err != nil {
+			notify.FailedDBList = append(notify.FailedDBList, db+" - "+name+" - Error: "+err.Error())
+			FailedDBNames = append(FailedDBNames, db)
+		} else {
+			notify.SuccessfulDBList = append(notify.SuccessfulDBList, db+" - "+name)
+		}
+	}
+	return len(states) > 0
+}
+
+// sftpTargetID identifies an SFTP target in upload states
+func sftpTargetID(target config.Target) string {
+	return target.User + "@" + target.Host + ":" + target.Port
+}
@@ -2,46 +2,97 @@ package backup
 
 import (
 	"bytes"
+	"errors"
 	"monodb-backup/config"
+	"os"
 	"os/exec"
+	"path"
 	"strings"
+	"time"
 
 	"github.com/pkg/sftp"
 )
 
-var lastDB, lastHost, lastPath string
-var folderCreated bool
-var rotating bool
-
-func SendRsync(srcPath, dstPath, db string, target config.Target) (string, error) {
-	var dst string
-
+func SendRsync(srcPath, dstPath, db string, target config.Target, m *manifest) (string, error) {
+	dst := nameWithPath(dstPath)
 	if target.Path != "" {
-		dst = target.Path + "/" + nameWithPath(dstPath)
-	} else {
-		dst = nameWithPath(dstPath)
+		dst = target.Path + "/" + dst
 	}
+	return sendRsyncFile(srcPath, dst, db, target, m)
+}
 
-	message, err := sendRsync(srcPath, dst, db, target)
+// sendRsyncFile sends a dump and its sidecars to one target, copies it for
+// rotation and cleans up old backups. The returned message describes the
+// failure of this target.
+func sendRsyncFile(srcPath, dst, db string, target config.Target, m *manifest) (string, error) {
+	sshOpts, cleanup, err := rsyncSSHOptions(target)
 	if err != nil {
+		message := "Couldn't set up ssh for " + target.Host + " - Error: " + err.Error()
+		logger.Error(message)
 		return message, err
 	}
+	defer cleanup()
 
-	if params.Rotation.Enabled {
-		extension := strings.Split(dstPath, ".")
-		shouldRotate, dstPath := rotate(extension[0], target.Host)
-		for i := 1; i < len(extension); i++ {
-			dstPath = dstPath + "." + extension[i]
-		}
-		if target.Path != "" {
-			dstPath = target.Path + "/" + dstPath
+	state := loadUploadState(sftpTargetID(target), dst, srcPath)
+	resume := state != nil && rsyncPartial(target, dst, state)
+	if state == nil {
+		state = newUploadState("rsync", sftpTargetID(target), dst, srcPath, db)
+	}
+	state.save()
+	if resume {
+		logger.Info("Resuming the upload of " + srcPath + " to " + target.Host + ":" + dst)
+	}
+	err = runRsync(srcPath, dst, target, sshOpts, resume)
+	if err != nil {
+		// the state is kept so that the partial file is appended to next time
+		message := "Couldn't send " + srcPath + " to " + target.Host + ":" + dst + " - Error: " + err.Error()
+		logger.Error(message)
+		return message, err
+	}
+	state.remove()
+	logger.Info("Successfully uploaded " + srcPath + " to " + target.Host + ":" + dst)
+
+	sidecars, err := writeSidecarsLocal(srcPath, m)
+	if err != nil {
+		return "Couldn't write sidecar files of " + srcPath + " - Error: " + err.Error(), err
+	}
+	for _, sc := range sidecars {
+		if err := runRsync(srcPath+sc.suffix, dst+sc.suffix, target, sshOpts, false); err != nil {
+			message := "Couldn't send " + srcPath + sc.suffix + " to " + target.Host + ":" + dst + sc.suffix + " - Error: " + err.Error()
+			logger.Error(message)
+			return message, err
 		}
+	}
+
+	if params.Rotation.Enabled {
+		shouldRotate, newDst := rotate(db, target.Host)
 		if shouldRotate {
-			rotating = true
-			return sendRsync(srcPath, dstPath, db, target)
+			extension := strings.Split(path.Base(dst), ".")
+			for i := 1; i < len(extension); i++ {
+				newDst = newDst + "." + extension[i]
+			}
+			if target.Path != "" {
+				newDst = target.Path + "/" + newDst
+			}
+			err := copyOnRemoteRsync(target, sshOpts, dst, newDst, sidecars)
+			if err != nil {
+				logger.Error("Couldn't copy " + target.Host + ":" + dst + " to " + newDst + " on the server, sending it again - Error: " + err.Error())
+				suffixes := []string{""}
+				for _, sc := range sidecars {
+					suffixes = append(suffixes, sc.suffix)
+				}
+				for _, suffix := range suffixes {
+					if err := runRsync(srcPath+suffix, newDst+suffix, target, sshOpts, false); err != nil {
+						message := "Couldn't send " + srcPath + suffix + " to " + target.Host + ":" + newDst + suffix + " - Error: " + err.Error()
+						logger.Error(message)
+						return message, err
+					}
+				}
+			} else {
+				logger.Info("Successfully copied " + target.Host + ":" + dst + " to " + newDst + " for rotation")
+			}
+			updateRotatedTimestamp(db, target.Host)
 		}
-		rotating = false
-		updateRotatedTimestamp(db, target.Host)
 	}
 
 	if params.Rotation.Keep.Daily > 0 || params.Rotation.Keep.Weekly > 0 || params.Rotation.Keep.Monthly > 0 {
@@ -65,73 +116,193 @@ func SendRsync(srcPath, dstPath, db string, target config.Target) (string, error
 	return "", nil
 }
 
-func sendRsync(srcPath, dstPath, db string, target config.Target) (string, error) {
-	var stderr1, stderr2, stdout bytes.Buffer
+func resumeRsyncUpload(state *uploadState, m *manifest) error {
+	for _, target := range params.BackupType.Info[0].Targets {
+		if sftpTargetID(target) == state.Target {
+			message, err := sendRsyncFile(state.Source, state.Key, state.Database, target, m)
+			if err != nil {
+				return errors.New(message)
+			}
+			return nil
+		}
+	}
+	state.remove()
+	return errors.New(state.Target + " is no longer a target")
+}
+
+// rsyncPartial tells whether the file at dst is what an interrupted transfer
+// left behind, so that --append-verify can continue it. Backups of earlier
+// days with the same name must be sent in full, since rsync skips files that
+// are already as long as the source in append mode.
+func rsyncPartial(target config.Target, dst string, state *uploadState) bool {
+	client, err := ConnectToSSH(target)
+	if err != nil {
+		return false
+	}
+	defer client.Close()
+	sftpCli, err := sftp.NewClient(client)
+	if err != nil {
+		return false
+	}
+	defer sftpCli.Close()
+	info, err := sftpCli.Stat(dst)
+	if err != nil {
+		return false
+	}
+	// an hour of slack for the clocks of the two hosts
+	return info.Size() < state.Size && info.ModTime().After(state.StartedAt.Add(-time.Hour))
+}
+
+// runRsync sends a single file. --partial keeps what has been transferred if
+// rsync is interrupted and appendVerify continues such a file, checking the
+// whole file once it is complete.
+func runRsync(srcPath, dstPath string, target config.Target, sshOpts []string, appendVerify bool) error {
+	var stderr, stdout bytes.Buffer
 
 	logger.Info("rsync transfer started.\n Source: " + srcPath + " - Destination: " + target.Host + ":" + dstPath)
 
-	fullPath := strings.Split(dstPath, "/")
-	newPath := fullPath[0]
-	for i := 1; i < len(fullPath)-1; i++ {
-		newPath = newPath + "/" + fullPath[i]
+	flags := target.Flags
+	if flags == "" {
+		flags = "-a"
 	}
-
-	if lastDB != db && folderCreated {
-		folderCreated = false
+	args, err := splitFlags(flags)
+	if err != nil {
+		return errors.New("invalid flags for " + target.Host + ": " + err.Error())
+	}
+	args = append(args, "--partial")
+	if appendVerify {
+		args = append(args, "--append-verify")
 	}
 
-	if !params.BackupAsTables {
-		cmdMkdir := exec.Command("ssh", "-o", "HostKeyAlgorithms=+ssh-rsa", "-o", "PubKeyAcceptedKeyTypes=+ssh-rsa", target.Host, "mkdir -p "+newPath)
-		err := cmdMkdir.Run()
-		if err != nil {
-			cmdMkdir.Stderr = &stderr1
-			message := "Couldn't create folder " + newPath + " to upload backups at" + target.Host + ":" + dstPath + "\nError: " + err.Error() + " " + stderr1.String()
-			logger.Error(message)
-			lastDB = db
-			lastPath = newPath
-			lastHost = target.Host
-			return message, err
+	remoteRsync := target.RsyncPath
+	if target.Mkpath {
+		args = append(args, "--mkpath")
+		if remoteRsync != "" {
+			args = append(args, "--rsync-path="+remoteRsync)
 		}
 	} else {
-		if (lastDB != db && !folderCreated) || lastHost != target.Host || rotating || lastPath != newPath {
-			cmdMkdir := exec.Command("ssh", "-o", "HostKeyAlgorithms=+ssh-rsa", "-o", "PubKeyAcceptedKeyTypes=+ssh-rsa", target.Host, "mkdir -p "+newPath)
-			err := cmdMkdir.Run()
-			if err != nil {
-				cmdMkdir.Stderr = &stderr1
-				message := "Couldn't create folder " + newPath + " to upload backups at" + target.Host + ":" + dstPath + "\nError: " + err.Error() + " " + stderr1.String() + "\nStill following up in case the folder exists and this was just a connection error"
-				// notify.SendAlarm(message, true)
-				logger.Error(message)
-				lastDB = db
-				lastPath = newPath
-				lastHost = target.Host
-			} else {
-				folderCreated = true
-			}
+		// --mkpath needs rsync 3.2.3 on both ends, the remote shell creates
+		// the directory before starting rsync instead
+		if remoteRsync == "" {
+			remoteRsync = "rsync"
 		}
+		args = append(args, "--rsync-path=mkdir -p "+shellQuote(path.Dir(dstPath))+" && "+remoteRsync)
+	}
+
+	bwLimit, err := rsyncBandwidthLimit(target.Bandwidth)
+	if err != nil {
+		return errors.New("invalid bandwidth settings for " + target.Host + ": " + err.Error())
+	}
+	if bwLimit != "" {
+		args = append(args, "--bwlimit="+bwLimit)
 	}
+	remoteShell, err := sshCommand(sshOpts)
+	if err != nil {
+		return err
+	}
+	args = append(args, "-e", remoteShell, srcPath, target.User+"@"+target.Host+":"+dstPath)
 
-	cmdRsync := exec.Command("/usr/bin/rsync", target.Flags, "-e", "ssh -o HostKeyAlgorithms=+ssh-rsa -o PubKeyAcceptedKeyTypes=+ssh-rsa", srcPath, target.User+"@"+target.Host+":"+dstPath)
-	cmdRsync.Stderr = &stderr2
-	cmdRsync.Stdout = &stdout
+	cmd := exec.Command("rsync", args...)
+	cmd.Stderr = &stderr
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return errors.New(err.Error() + " " + strings.TrimSpace(stderr.String()+" "+stdout.String()))
+	}
+	return nil
+}
 
-	err := cmdRsync.Run()
+// rsyncSSHOptions are the ssh options for rsync's remote shell and the cp
+// run for rotation: host key verification, port and identity. BatchMode
+// makes ssh fail instead of waiting for a password nobody will type.
+func rsyncSSHOptions(target config.Target) ([]string, func(), error) {
+	opts, cleanup, err := sshOptions(target)
 	if err != nil {
-		message := "Couldn't send " + srcPath + " to " + target.Host + ":" + dstPath + "\nError: " + err.Error() + " " + stderr2.String() + " Stdout: " + stdout.String()
-		// notify.SendAlarm(message, true)
-		logger.Error(message)
-		lastDB = db
-		lastPath = newPath
-		lastHost = target.Host
-		return message, err
+		return nil, cleanup, err
+	}
+	opts = append(opts, "-o", "BatchMode=yes")
+	if target.Port != "" {
+		opts = append(opts, "-p", target.Port)
+	}
+	if target.IdentityFile != "" {
+		opts = append(opts, "-i", expandHome(target.IdentityFile), "-o", "IdentitiesOnly=yes")
+	}
+	if target.CertificateFile != "" {
+		opts = append(opts, "-o", "CertificateFile="+expandHome(target.CertificateFile))
+	}
+	return opts, cleanup, nil
+}
+
+// splitFlags splits rsync flags like a shell would, so that quoted values
+// such as --exclude='a b' stay one argument
+func splitFlags(s string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	var quote rune
+	inArg, escaped := false, false
+	for _, r := range s {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else if r == '\\' && quote == '"' {
+				escaped = true
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == '\\':
+			escaped = true
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errors.New("unterminated quote or escape in " + s)
+	}
+	if inArg {
+		args = append(args, current.String())
 	}
+	return args, nil
+}
 
-	message := "Successfully uploaded " + srcPath + " to " + target.Host + ":" + dstPath
-	logger.Info(message)
-	// notify.SendAlarm(message, false)
-	// itWorksNow(message, true)
+// writeSidecarsLocal stores the sidecars next to the local dump so that they
+// can be sent with rsync like any other file.
+func writeSidecarsLocal(srcPath string, m *manifest) ([]sidecar, error) {
+	sidecars := m.sidecars(srcPath)
+	for _, sc := range sidecars {
+		if err := os.WriteFile(srcPath+sc.suffix, sc.data, 0660); err != nil {
+			logger.Error("Couldn't write " + srcPath + sc.suffix + " - Error: " + err.Error())
+			return nil, err
+		}
+	}
+	return sidecars, nil
+}
 
-	lastDB = db
-	lastPath = newPath
-	lastHost = target.Host
-	return "", nil
+// copyOnRemoteRsync copies an artifact that was just sent, along with its
+// sidecars, with cp on the target instead of running rsync again
+func copyOnRemoteRsync(target config.Target, sshOpts []string, src, dst string, sidecars []sidecar) error {
+	var stderr bytes.Buffer
+	command := remoteCopyCommand(src, dst)
+	for _, sc := range sidecars {
+		command += " && cp " + shellQuote(src+sc.suffix) + " " + shellQuote(dst+sc.suffix)
+	}
+	cmd := exec.Command("ssh", append(sshOpts, target.User+"@"+target.Host, command)...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return errors.New(err.Error() + " " + stderr.String())
+	}
+	return nil
 }
@@ -0,0 +1,60 @@
+package backup
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitFlags(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{in: "", want: nil},
+		{in: "-a", want: []string{"-a"}},
+		{in: "  -a \t-z\n--delete  ", want: []string{"-a", "-z", "--delete"}},
+		{in: `--exclude='*.tmp' -a`, want: []string{"--exclude=*.tmp", "-a"}},
+		{in: `--rsh="ssh -p 2222"`, want: []string{"--rsh=ssh -p 2222"}},
+		{in: `'it"s'`, want: []string{`it"s`}},
+		{in: `"it's"`, want: []string{"it's"}},
+		{in: `"a \"b\" \\c"`, want: []string{`a "b" \c`}},
+		{in: `'a \b'`, want: []string{`a \b`}},
+		{in: `a\ b c`, want: []string{"a b", "c"}},
+		{in: `''`, want: []string{""}},
+		{in: `-a "" -z`, want: []string{"-a", "", "-z"}},
+		{in: `--exclude='x`, wantErr: true},
+		{in: `"x`, wantErr: true},
+		{in: `-a \`, wantErr: true},
+		{in: `"x\"`, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := splitFlags(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("splitFlags(%q) = %q, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("splitFlags(%q) returned %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitFlags(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSSHCommand(t *testing.T) {
+	got, err := sshCommand([]string{"-o", "UserKnownHostsFile=/tmp/known hosts", "-p", "22"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "ssh '-o' 'UserKnownHostsFile=/tmp/known hosts' '-p' '22'"; got != want {
+		t.Errorf("sshCommand = %q, want %q", got, want)
+	}
+	if got, err := sshCommand([]string{"-i", "/keys/it's"}); err == nil {
+		t.Errorf("sshCommand with a single quote = %q, want an error", got)
+	}
+}
@@ -1,16 +1,17 @@
 package backup
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"io"
 	"monodb-backup/config"
 	"monodb-backup/notify"
 	"net"
 	"net/http"
 	"os"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -27,6 +28,8 @@ type uploaderStruct struct {
 	instance config.BackupTypeInfo
 	client   *s3.Client
 	uploader *manager.Uploader
+	sse      sseSettings
+	throttle *throttle
 }
 
 var uploaders []uploaderStruct
@@ -40,6 +43,10 @@ func mustGetSystemCertPool() *x509.CertPool {
 }
 
 func InitializeS3Session() {
+	if len(uploaders) > 0 {
+		// already initialized by an earlier run or by scrub
+		return
+	}
 	ctx := context.Background()
 
 	for _, s3Instance := range params.BackupType.Info {
@@ -105,48 +112,117 @@ func InitializeS3Session() {
 			}
 		})
 
+		sse, err := newSSESettings(s3Instance.ServerSideEncryption)
+		if err != nil {
+			logger.Fatal("Invalid server side encryption settings for bucket " + s3Instance.Bucket + ": " + err.Error())
+			return
+		}
+
+		if err := checkObjectLock(ctx, client, s3Instance); err != nil {
+			logger.Fatal("Invalid object lock settings for bucket " + s3Instance.Bucket + ": " + err.Error())
+			return
+		}
+
+		throttle, err := newThrottle(s3Instance.Bandwidth)
+		if err != nil {
+			logger.Fatal("Invalid bandwidth settings for bucket " + s3Instance.Bucket + ": " + err.Error())
+			return
+		}
+
 		uploader := manager.NewUploader(client, func(u *manager.Uploader) {
 			u.PartSize = config.Parameters.PartSize * 1024 * 1024
+			if s3Instance.PartSize > 0 {
+				u.PartSize = s3Instance.PartSize * 1024 * 1024
+			}
 			u.Concurrency = 10
+			if s3Instance.Concurrency > 0 {
+				u.Concurrency = s3Instance.Concurrency
+			}
 		})
 
 		uploaders = append(uploaders, uploaderStruct{
 			instance: s3Instance,
 			client:   client,
+			sse:      sse,
+			throttle: throttle,
 			uploader: uploader,
 		})
 	}
 }
 
-func uploadFileToS3(ctx context.Context, src, dst, db string, reader io.Reader, s3Instance *uploaderStruct) error {
+// uploadFileToS3 uploads src, or reader while a dump is streamed into it.
+// partSize is the first part size of a streamed upload, 0 for the configured
+// one.
+func uploadFileToS3(ctx context.Context, src, dst, db string, reader io.Reader, s3Instance *uploaderStruct, m *manifest, partSize int64) error {
 	bucketName := s3Instance.instance.Bucket
+	var file *os.File
+	var fileSize int64
 	if reader == nil {
 		src = strings.TrimSuffix(src, "/")
-		file, err := os.Open(src)
+		var err error
+		file, err = os.Open(src)
 		if err != nil {
 			logger.Error("Couldn't open file " + src + " to read - Error: " + err.Error())
 			return err
 		}
 		defer file.Close()
+		if info, err := file.Stat(); err == nil {
+			fileSize = info.Size()
+		}
 		logger.Info("Successfully opened file " + src + " to read.")
 		reader = file
 	} else {
 		src = db
 	}
 
-	_, err := s3Instance.uploader.Upload(ctx, &s3.PutObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(dst),
-		Body:   reader,
-	})
+	// a streamed dump's checksum is only known once it has been uploaded
+	checksumLater := m != nil && m.SHA256 == ""
+	var err error
+	if file != nil && resumeEnabled() && fileSize > s3Instance.uploader.PartSize {
+		err = uploadFileResumable(ctx, s3Instance, src, dst, db, file, fileSize, m)
+	} else {
+		input := s3Instance.preparePut(&s3.PutObjectInput{
+			Bucket:            aws.String(bucketName),
+			Key:               aws.String(dst),
+			Body:              s3Instance.throttle.reader(reader),
+			ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+			Metadata:          s3Metadata(m, dst),
+			Tagging:           s3Tagging(m, dst),
+		})
+		if file == nil {
+			if partSize == 0 {
+				partSize = s3Instance.uploader.PartSize
+			}
+			err = uploadStreamToS3(ctx, s3Instance, input, partSize)
+		} else {
+			_, err = s3Instance.uploader.Upload(ctx, input)
+		}
+	}
 	if err != nil {
 		logger.Error("Couldn't upload " + src + " to S3\nBucket: " + bucketName + " path: " + dst + "\n Error: " + err.Error())
 		return err
 	}
+	if err := verifyS3Upload(ctx, s3Instance, dst, m); err != nil {
+		logger.Error("Couldn't verify " + src + " on S3\nBucket: " + bucketName + " path: " + dst + "\n Error: " + err.Error())
+		return err
+	}
+
+	// the checksum of a streamed dump is in its sidecars, only its tags are
+	// replaced instead of rewriting the object
+	if checksumLater {
+		if err := putS3Tags(ctx, s3Instance, dst, m); err != nil {
+			logger.Error("Couldn't tag " + src + " on S3\nBucket: " + bucketName + " path: " + dst + "\n Error: " + err.Error())
+			return err
+		}
+	}
 
 	message := "Successfully uploaded " + src + " to S3\nBucket: " + bucketName + " path: " + dst
 	logger.Info(message)
 
+	if err := putSidecarsToS3(ctx, s3Instance, dst, m); err != nil {
+		return err
+	}
+
 	if params.Rotation.Enabled {
 		if db == "mysql" {
 			db = db + "_users"
@@ -161,23 +237,15 @@ func uploadFileToS3(ctx context.Context, src, dst, db string, reader io.Reader,
 			name = name + "." + extension[i]
 		}
 		if shouldRotate {
-			sourceObj, err := s3Instance.client.GetObject(ctx, &s3.GetObjectInput{
-				Bucket: aws.String(bucketName),
-				Key:    aws.String(dst),
-			})
-			if err != nil {
-				logger.Error("Couldn't get source object for rotation\nBucket: " + bucketName + " path: " + dst + "\n Error: " + err.Error())
+			if err := copyS3Object(ctx, s3Instance, dst, name, m); err != nil {
+				logger.Error("Couldn't create copy of " + src + " for rotation\nBucket: " + bucketName + " path: " + name + "\n Error: " + err.Error())
 				return err
 			}
-			defer sourceObj.Body.Close()
-
-			_, err = s3Instance.uploader.Upload(ctx, &s3.PutObjectInput{
-				Bucket: aws.String(bucketName),
-				Key:    aws.String(name),
-				Body:   sourceObj.Body,
-			})
-			if err != nil {
-				logger.Error("Couldn't create copy of " + src + " for rotation\nBucket: " + bucketName + " path: " + name + "\n Error: " + err.Error())
+			if err := verifyS3Upload(ctx, s3Instance, name, m); err != nil {
+				logger.Error("Couldn't verify rotation copy of " + src + " on S3\nBucket: " + bucketName + " path: " + name + "\n Error: " + err.Error())
+				return err
+			}
+			if err := putSidecarsToS3(ctx, s3Instance, name, m); err != nil {
 				return err
 			}
 			updateRotatedTimestamp(db, targetID)
@@ -194,6 +262,68 @@ func uploadFileToS3(ctx context.Context, src, dst, db string, reader io.Reader,
 	return nil
 }
 
+// verifyS3Upload compares the stored object with what was hashed during the
+// upload. S3 validates every part against its SHA-256 while receiving it,
+// multipart objects only have a checksum of checksums so their size is
+// compared instead.
+func verifyS3Upload(ctx context.Context, s3Instance *uploaderStruct, dst string, m *manifest) error {
+	if m == nil || m.SHA256 == "" {
+		return nil
+	}
+	head, err := s3Instance.client.HeadObject(ctx, s3Instance.sse.applyHead(&s3.HeadObjectInput{
+		Bucket:       aws.String(s3Instance.instance.Bucket),
+		Key:          aws.String(dst),
+		ChecksumMode: types.ChecksumModeEnabled,
+	}))
+	if err != nil {
+		return err
+	}
+	if head.ContentLength != nil && *head.ContentLength != m.Size {
+		return errors.New("size mismatch for " + dst + " - expected: " + strconv.FormatInt(m.Size, 10) + " got: " + strconv.FormatInt(*head.ContentLength, 10))
+	}
+	if head.ChecksumSHA256 != nil && !strings.Contains(*head.ChecksumSHA256, "-") {
+		if actual := base64ToHex(*head.ChecksumSHA256); actual != m.SHA256 {
+			return checksumMismatch(dst, m.SHA256, actual)
+		}
+	} else if params.Checksum.VerifyUpload {
+		// multipart uploads only have a checksum of their parts' checksums
+		obj, err := s3Instance.client.GetObject(ctx, s3Instance.sse.applyGet(&s3.GetObjectInput{
+			Bucket: aws.String(s3Instance.instance.Bucket),
+			Key:    aws.String(dst),
+		}))
+		if err != nil {
+			return err
+		}
+		defer obj.Body.Close()
+		actual, _, err := hashReader(obj.Body)
+		if err != nil {
+			return err
+		}
+		if actual != m.SHA256 {
+			return checksumMismatch(dst, m.SHA256, actual)
+		}
+	}
+	logger.Info("Verified " + dst + " on S3, sha256: " + m.SHA256)
+	return nil
+}
+
+func putSidecarsToS3(ctx context.Context, s3Instance *uploaderStruct, dst string, m *manifest) error {
+	for _, sc := range m.sidecars(dst) {
+		_, err := s3Instance.client.PutObject(ctx, s3Instance.preparePut(&s3.PutObjectInput{
+			Bucket:            aws.String(s3Instance.instance.Bucket),
+			Key:               aws.String(dst + sc.suffix),
+			Body:              bytes.NewReader(sc.data),
+			ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+			Tagging:           s3Tagging(m, dst),
+		}))
+		if err != nil {
+			logger.Error("Couldn't upload " + dst + sc.suffix + " to S3\nBucket: " + s3Instance.instance.Bucket + "\n Error: " + err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
 func cleanupS3(ctx context.Context, s3Instance *uploaderStruct) error {
 	bucketName := s3Instance.instance.Bucket
 
@@ -229,25 +359,9 @@ func cleanupS3(ctx context.Context, s3Instance *uploaderStruct) error {
 			}
 		}
 
-		var toDelete []BackupFile
-		re := regexp.MustCompile(`(.+)-(week_\d+|Jan|Feb|Mar|Apr|May|Jun|Jul|Aug|Sep|Oct|Nov|Dec|Mon|Tue|Wed|Thu|Fri|Sat|Sun)`)
-
-		grouped := make(map[string][]BackupFile)
-		for _, f := range backups {
-			parts := strings.Split(f.Name, "/")
-			filename := parts[len(parts)-1]
-			dbName := ""
-			matches := re.FindStringSubmatch(filename)
-			if len(matches) > 1 {
-				dbName = matches[1]
-			} else {
-				dbName = filename
-			}
-			grouped[dbName] = append(grouped[dbName], f)
-		}
-
-		for _, group := range grouped {
-			toDelete = append(toDelete, getFilesToDelete(group, period, keep)...)
+		toDelete := selectExpired(backups, period, keep)
+		if s3Instance.instance.ObjectLock.Enabled {
+			toDelete = skipLockedS3(ctx, s3Instance, toDelete)
 		}
 
 		if len(toDelete) > 0 {
@@ -262,7 +376,7 @@ func cleanupS3(ctx context.Context, s3Instance *uploaderStruct) error {
 					end = len(objects)
 				}
 
-				_, err := s3Instance.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+				out, err := s3Instance.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
 					Bucket: aws.String(bucketName),
 					Delete: &types.Delete{
 						Objects: objects[i:end],
@@ -271,7 +385,12 @@ func cleanupS3(ctx context.Context, s3Instance *uploaderStruct) error {
 				if err != nil {
 					return err
 				}
-				logger.Info("Deleted " + strconv.Itoa(len(objects[i:end])) + " old backups from S3 prefix: " + realPrefix)
+				// locked objects are refused one by one, they are deleted by a
+				// later run once their retention is over
+				for _, e := range out.Errors {
+					logger.Info("Skipped deleting " + aws.ToString(e.Key) + " from S3 - " + aws.ToString(e.Code) + ": " + aws.ToString(e.Message))
+				}
+				logger.Info("Deleted " + strconv.Itoa(len(out.Deleted)) + " old backups from S3 prefix: " + realPrefix)
 			}
 		}
 		return nil
@@ -297,14 +416,42 @@ func cleanupS3(ctx context.Context, s3Instance *uploaderStruct) error {
 
 }
 
-func uploadToS3(src, dst, db string) {
+// skipLockedS3 removes the objects that are still under retention or legal
+// hold, together with the sidecars of locked artifacts
+func skipLockedS3(ctx context.Context, s3Instance *uploaderStruct, files []BackupFile) []BackupFile {
+	locked := make(map[string]bool)
+	for _, f := range files {
+		if isSidecar(f.Path) {
+			continue
+		}
+		isLocked, err := isObjectLocked(ctx, s3Instance, f.Path)
+		if err != nil {
+			logger.Error("Couldn't get the lock status of " + f.Path + ", not deleting it - Error: " + err.Error())
+			isLocked = true
+		}
+		if isLocked {
+			logger.Info("Not deleting " + f.Path + " from S3, it is locked")
+			locked[f.Path] = true
+		}
+	}
+	var deletable []BackupFile
+	for _, f := range files {
+		if locked[f.Path] || (isSidecar(f.Path) && locked[sidecarOwner(f.Path)]) {
+			continue
+		}
+		deletable = append(deletable, f)
+	}
+	return deletable
+}
+
+func uploadToS3(src, dst, db string, m *manifest) {
 	ctx := context.Background()
 	for _, s3Instance := range uploaders {
 		finalDst := nameWithPath(dst)
 		if s3Instance.instance.Path != "" {
 			finalDst = s3Instance.instance.Path + "/" + finalDst
 		}
-		err := uploadFileToS3(ctx, src, finalDst, db, nil, &s3Instance)
+		err := uploadFileToS3(ctx, src, finalDst, db, nil, &s3Instance, m, 0)
 		if err != nil {
 			notify.FailedDBList = append(notify.FailedDBList, db+" - "+src+" - "+err.Error())
 		} else {
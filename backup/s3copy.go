@@ -0,0 +1,157 @@
+package backup
+
+import (
+	"context"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// maxCopyObjectSize is the largest object CopyObject accepts, bigger ones are
+// copied part by part with UploadPartCopy
+const maxCopyObjectSize = 5 * 1024 * 1024 * 1024
+
+const maxPartCount = 10000
+
+// copySource encodes bucket/key the way CopySource expects it
+func copySource(bucket, key string) *string {
+	parts := strings.Split(key, "/")
+	for i := range parts {
+		parts[i] = url.PathEscape(parts[i])
+	}
+	return aws.String(bucket + "/" + strings.Join(parts, "/"))
+}
+
+// copyS3Object creates a rotation copy of src inside the bucket without
+// downloading it. The copy gets its own metadata, tags and retention since
+// its tier differs from the source's.
+func copyS3Object(ctx context.Context, s3Instance *uploaderStruct, src, dst string, m *manifest) error {
+	head, err := s3Instance.client.HeadObject(ctx, s3Instance.sse.applyHead(&s3.HeadObjectInput{
+		Bucket: aws.String(s3Instance.instance.Bucket),
+		Key:    aws.String(src),
+	}))
+	if err != nil {
+		return err
+	}
+	size := aws.ToInt64(head.ContentLength)
+	if size > maxCopyObjectSize {
+		return copyS3ObjectMultipart(ctx, s3Instance, src, dst, size, m)
+	}
+
+	input := &s3.CopyObjectInput{
+		Bucket:            aws.String(s3Instance.instance.Bucket),
+		Key:               aws.String(dst),
+		CopySource:        copySource(s3Instance.instance.Bucket, src),
+		ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+		MetadataDirective: types.MetadataDirectiveReplace,
+		Metadata:          s3Metadata(m, dst),
+	}
+	if tagging := s3Tagging(m, dst); tagging != nil {
+		input.TaggingDirective = types.TaggingDirectiveReplace
+		input.Tagging = tagging
+	}
+	input.ObjectLockMode, input.ObjectLockRetainUntilDate = objectLockFor(s3Instance.instance.ObjectLock, dst)
+	_, err = s3Instance.client.CopyObject(ctx, s3Instance.sse.applyCopy(input))
+	return err
+}
+
+func copyS3ObjectMultipart(ctx context.Context, s3Instance *uploaderStruct, src, dst string, size int64, m *manifest) error {
+	bucketName := s3Instance.instance.Bucket
+	partSize := s3Instance.uploader.PartSize
+	if minPartSize := (size + maxPartCount - 1) / maxPartCount; partSize < minPartSize {
+		partSize = minPartSize
+	}
+	if partSize > maxCopyObjectSize {
+		partSize = maxCopyObjectSize
+	}
+
+	input := &s3.CreateMultipartUploadInput{
+		Bucket:            aws.String(bucketName),
+		Key:               aws.String(dst),
+		ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+		Metadata:          s3Metadata(m, dst),
+		Tagging:           s3Tagging(m, dst),
+	}
+	input.ObjectLockMode, input.ObjectLockRetainUntilDate = objectLockFor(s3Instance.instance.ObjectLock, dst)
+	upload, err := s3Instance.client.CreateMultipartUpload(ctx, s3Instance.sse.applyCreateMultipart(input))
+	if err != nil {
+		return err
+	}
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		parts    []types.CompletedPart
+		firstErr error
+	)
+	concurrency := s3Instance.uploader.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	for offset, partNumber := int64(0), int32(1); offset < size; offset, partNumber = offset+partSize, partNumber+1 {
+		end := offset + partSize - 1
+		if end >= size {
+			end = size - 1
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(partNumber int32, byteRange string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			out, err := s3Instance.client.UploadPartCopy(ctx, s3Instance.sse.applyUploadPartCopy(&s3.UploadPartCopyInput{
+				Bucket:          aws.String(bucketName),
+				Key:             aws.String(dst),
+				CopySource:      copySource(bucketName, src),
+				CopySourceRange: aws.String(byteRange),
+				PartNumber:      aws.Int32(partNumber),
+				UploadId:        upload.UploadId,
+			}))
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			parts = append(parts, types.CompletedPart{
+				ETag:           out.CopyPartResult.ETag,
+				ChecksumSHA256: out.CopyPartResult.ChecksumSHA256,
+				PartNumber:     aws.Int32(partNumber),
+			})
+		}(partNumber, "bytes="+strconv.FormatInt(offset, 10)+"-"+strconv.FormatInt(end, 10))
+	}
+	wg.Wait()
+
+	if firstErr == nil {
+		sort.Slice(parts, func(i, j int) bool { return *parts[i].PartNumber < *parts[j].PartNumber })
+		_, firstErr = s3Instance.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:               aws.String(bucketName),
+			Key:                  aws.String(dst),
+			UploadId:             upload.UploadId,
+			MultipartUpload:      &types.CompletedMultipartUpload{Parts: parts},
+			SSECustomerAlgorithm: s3Instance.sse.customerAlgorithm,
+			SSECustomerKey:       s3Instance.sse.customerKey,
+			SSECustomerKeyMD5:    s3Instance.sse.customerKeyMD5,
+		})
+	}
+	if firstErr != nil {
+		_, err := s3Instance.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(bucketName),
+			Key:      aws.String(dst),
+			UploadId: upload.UploadId,
+		})
+		if err != nil {
+			logger.Error("Couldn't abort multipart copy of " + dst + "\nBucket: " + bucketName + "\n Error: " + err.Error())
+		}
+		return firstErr
+	}
+	return nil
+}
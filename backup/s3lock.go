@@ -0,0 +1,162 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"monodb-backup/config"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func parseObjectLockMode(mode string) (types.ObjectLockMode, error) {
+	switch strings.ToUpper(mode) {
+	case "GOVERNANCE":
+		return types.ObjectLockModeGovernance, nil
+	case "COMPLIANCE":
+		return types.ObjectLockModeCompliance, nil
+	case "", "OFF":
+		return "", nil
+	default:
+		return "", errors.New("unknown object lock mode " + mode + ", should be governance, compliance or off")
+	}
+}
+
+// checkObjectLock validates the modes and makes sure the bucket was created
+// with object lock, S3 rejects retention settings otherwise.
+func checkObjectLock(ctx context.Context, client *s3.Client, info config.BackupTypeInfo) error {
+	if !info.ObjectLock.Enabled {
+		return nil
+	}
+	if _, err := parseObjectLockMode(info.ObjectLock.Mode); err != nil {
+		return err
+	}
+	for _, mode := range info.ObjectLock.Tiers {
+		if _, err := parseObjectLockMode(mode); err != nil {
+			return err
+		}
+	}
+	out, err := client.GetObjectLockConfiguration(ctx, &s3.GetObjectLockConfigurationInput{
+		Bucket: aws.String(info.Bucket),
+	})
+	if err != nil {
+		return errors.New("couldn't get the object lock configuration, the bucket should be created with object lock enabled - " + err.Error())
+	}
+	if out.ObjectLockConfiguration == nil || out.ObjectLockConfiguration.ObjectLockEnabled != types.ObjectLockEnabledEnabled {
+		return errors.New("object lock isn't enabled for the bucket")
+	}
+	return nil
+}
+
+// retainUntil returns how long an object of tier has to survive, based on the
+// rotation's keep counts. Daily, hourly and custom backups are kept for
+// keep.daily days since their folders are reused every week.
+func retainUntil(tier string, now time.Time) (time.Time, bool) {
+	keep := params.Rotation.Keep
+	switch tier {
+	case "daily", "hourly", "custom":
+		if keep.Daily > 0 {
+			return now.AddDate(0, 0, keep.Daily), true
+		}
+	case "weekly":
+		if keep.Weekly > 0 {
+			return now.AddDate(0, 0, 7*keep.Weekly), true
+		}
+	case "monthly":
+		if keep.Monthly > 0 {
+			return now.AddDate(0, keep.Monthly, 0), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// objectLockFor returns the retention of the tier key is uploaded to. Tiers
+// without a keep count are left to the bucket's default retention.
+func objectLockFor(lock config.ObjectLock, key string) (types.ObjectLockMode, *time.Time) {
+	if !lock.Enabled {
+		return "", nil
+	}
+	tier := rotationTier(key)
+	modeName := lock.Mode
+	if tierMode, ok := lock.Tiers[tier]; ok {
+		modeName = tierMode
+	}
+	mode, _ := parseObjectLockMode(modeName)
+	if mode == "" {
+		return "", nil
+	}
+	until, ok := retainUntil(tier, time.Now())
+	if !ok {
+		return "", nil
+	}
+	return mode, aws.Time(until)
+}
+
+func applyObjectLock(lock config.ObjectLock, input *s3.PutObjectInput) *s3.PutObjectInput {
+	input.ObjectLockMode, input.ObjectLockRetainUntilDate = objectLockFor(lock, aws.ToString(input.Key))
+	return input
+}
+
+// preparePut applies the target's server side encryption and object lock
+// settings to an upload
+func (s3Instance *uploaderStruct) preparePut(input *s3.PutObjectInput) *s3.PutObjectInput {
+	return s3Instance.sse.applyPut(applyObjectLock(s3Instance.instance.ObjectLock, input))
+}
+
+// isObjectLocked reports whether key is under retention or legal hold and
+// can't be deleted yet
+func isObjectLocked(ctx context.Context, s3Instance *uploaderStruct, key string) (bool, error) {
+	head, err := s3Instance.client.HeadObject(ctx, s3Instance.sse.applyHead(&s3.HeadObjectInput{
+		Bucket: aws.String(s3Instance.instance.Bucket),
+		Key:    aws.String(key),
+	}))
+	if err != nil {
+		return false, err
+	}
+	if head.ObjectLockLegalHoldStatus == types.ObjectLockLegalHoldStatusOn {
+		return true, nil
+	}
+	return head.ObjectLockRetainUntilDate != nil && head.ObjectLockRetainUntilDate.After(time.Now()), nil
+}
+
+// Pin puts a legal hold on a stored backup and its sidecar files so neither
+// the retention nor anyone with the access key can delete it until it is
+// unpinned. key is the object's key inside the bucket.
+func Pin(key string, pinned bool) error {
+	if params.BackupType.Type != "s3" && params.BackupType.Type != "minio" {
+		return errors.New("pinning backups is only supported for s3 and minio")
+	}
+	InitializeS3Session()
+	ctx := context.Background()
+	status := types.ObjectLockLegalHoldStatusOff
+	if pinned {
+		status = types.ObjectLockLegalHoldStatusOn
+	}
+	for i := range uploaders {
+		s3Instance := &uploaders[i]
+		keys := []string{key}
+		for _, suffix := range sidecarSuffixes {
+			keys = append(keys, key+suffix)
+		}
+		for j, k := range keys {
+			_, err := s3Instance.client.PutObjectLegalHold(ctx, &s3.PutObjectLegalHoldInput{
+				Bucket:    aws.String(s3Instance.instance.Bucket),
+				Key:       aws.String(k),
+				LegalHold: &types.ObjectLockLegalHold{Status: status},
+			})
+			if err != nil {
+				if j > 0 {
+					// backups uploaded before sidecars existed don't have them
+					continue
+				}
+				logger.Error("Couldn't set legal hold of " + k + "\nBucket: " + s3Instance.instance.Bucket + "\n Error: " + err.Error())
+				return err
+			}
+		}
+		logger.Info("Legal hold of " + key + " is now " + string(status) + "\nBucket: " + s3Instance.instance.Bucket)
+	}
+	return nil
+}
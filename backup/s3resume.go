@@ -0,0 +1,245 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func s3TargetID(s3Instance *uploaderStruct) string {
+	return s3Instance.instance.Endpoint + "/" + s3Instance.instance.Bucket
+}
+
+// uploadFileResumable uploads a local dump part by part. The upload ID is
+// kept in resume.stateDir so that an interrupted upload only sends the parts
+// S3 doesn't have yet when it is run again.
+func uploadFileResumable(ctx context.Context, s3Instance *uploaderStruct, src, dst, db string, file *os.File, size int64, m *manifest) error {
+	bucketName := s3Instance.instance.Bucket
+	var uploaded map[int32]types.CompletedPart
+	state := loadUploadState(s3TargetID(s3Instance), dst, src)
+	if state != nil && state.UploadID != "" {
+		var err error
+		uploaded, err = listUploadedParts(ctx, s3Instance, dst, state.UploadID)
+		if err != nil {
+			logger.Info("Couldn't resume the upload of " + src + ", starting over - Error: " + err.Error())
+			state = nil
+		} else {
+			logger.Info("Resuming the upload of " + src + " to " + bucketName + "/" + dst + ", " + strconv.Itoa(len(uploaded)) + " parts are already uploaded")
+		}
+	}
+	if state == nil {
+		state = newUploadState("s3", s3TargetID(s3Instance), dst, src, db)
+		if state == nil {
+			return errors.New("couldn't read " + src)
+		}
+		state.PartSize = s3Instance.uploader.PartSize
+		if minPartSize := (size + maxPartCount - 1) / maxPartCount; state.PartSize < minPartSize {
+			state.PartSize = minPartSize
+		}
+		input := &s3.CreateMultipartUploadInput{
+			Bucket:            aws.String(bucketName),
+			Key:               aws.String(dst),
+			ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+			Metadata:          s3Metadata(m, dst),
+			Tagging:           s3Tagging(m, dst),
+		}
+		input.ObjectLockMode, input.ObjectLockRetainUntilDate = objectLockFor(s3Instance.instance.ObjectLock, dst)
+		upload, err := s3Instance.client.CreateMultipartUpload(ctx, s3Instance.sse.applyCreateMultipart(input))
+		if err != nil {
+			return err
+		}
+		state.UploadID = aws.ToString(upload.UploadId)
+		state.save()
+		uploaded = make(map[int32]types.CompletedPart)
+	}
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+	)
+	have := make(map[int32]bool, len(uploaded))
+	for partNumber := range uploaded {
+		have[partNumber] = true
+	}
+	// the parts are read concurrently, they share the upload's bandwidth
+	limiter := s3Instance.throttle.limiter()
+	sem := make(chan struct{}, s3Instance.uploader.Concurrency)
+	for offset, partNumber := int64(0), int32(1); offset < size; offset, partNumber = offset+state.PartSize, partNumber+1 {
+		if have[partNumber] {
+			continue
+		}
+		length := state.PartSize
+		if offset+length > size {
+			length = size - offset
+		}
+		sem <- struct{}{}
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			<-sem
+			break
+		}
+		wg.Add(1)
+		go func(partNumber int32, offset, length int64) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			// parts are read into memory so that the SDK can hash and retry them
+			part := make([]byte, length)
+			_, err := io.ReadFull(limiter.reader(io.NewSectionReader(file, offset, length)), part)
+			var out *s3.UploadPartOutput
+			if err == nil {
+				out, err = s3Instance.client.UploadPart(ctx, &s3.UploadPartInput{
+					Bucket:               aws.String(bucketName),
+					Key:                  aws.String(dst),
+					UploadId:             aws.String(state.UploadID),
+					PartNumber:           aws.Int32(partNumber),
+					Body:                 bytes.NewReader(part),
+					ContentLength:        aws.Int64(length),
+					ChecksumAlgorithm:    types.ChecksumAlgorithmSha256,
+					SSECustomerAlgorithm: s3Instance.sse.customerAlgorithm,
+					SSECustomerKey:       s3Instance.sse.customerKey,
+					SSECustomerKeyMD5:    s3Instance.sse.customerKeyMD5,
+				})
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			uploaded[partNumber] = types.CompletedPart{
+				ETag:           out.ETag,
+				ChecksumSHA256: out.ChecksumSHA256,
+				PartNumber:     aws.Int32(partNumber),
+			}
+		}(partNumber, offset, length)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		// the upload is left for the next run to resume
+		return firstErr
+	}
+
+	parts := make([]types.CompletedPart, 0, len(uploaded))
+	for _, part := range uploaded {
+		parts = append(parts, part)
+	}
+	sort.Slice(parts, func(i, j int) bool { return *parts[i].PartNumber < *parts[j].PartNumber })
+	_, err := s3Instance.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:               aws.String(bucketName),
+		Key:                  aws.String(dst),
+		UploadId:             aws.String(state.UploadID),
+		MultipartUpload:      &types.CompletedMultipartUpload{Parts: parts},
+		SSECustomerAlgorithm: s3Instance.sse.customerAlgorithm,
+		SSECustomerKey:       s3Instance.sse.customerKey,
+		SSECustomerKeyMD5:    s3Instance.sse.customerKeyMD5,
+	})
+	if err != nil {
+		return err
+	}
+	state.remove()
+	return nil
+}
+
+// listUploadedParts asks S3 which parts of an unfinished upload it already
+// has, S3 is the authority on that rather than the saved state
+func listUploadedParts(ctx context.Context, s3Instance *uploaderStruct, key, uploadID string) (map[int32]types.CompletedPart, error) {
+	parts := make(map[int32]types.CompletedPart)
+	paginator := s3.NewListPartsPaginator(s3Instance.client, &s3.ListPartsInput{
+		Bucket:               aws.String(s3Instance.instance.Bucket),
+		Key:                  aws.String(key),
+		UploadId:             aws.String(uploadID),
+		SSECustomerAlgorithm: s3Instance.sse.customerAlgorithm,
+		SSECustomerKey:       s3Instance.sse.customerKey,
+		SSECustomerKeyMD5:    s3Instance.sse.customerKeyMD5,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, part := range page.Parts {
+			parts[aws.ToInt32(part.PartNumber)] = types.CompletedPart{
+				ETag:           part.ETag,
+				ChecksumSHA256: part.ChecksumSHA256,
+				PartNumber:     part.PartNumber,
+			}
+		}
+	}
+	return parts, nil
+}
+
+func resumeS3Upload(state *uploadState, m *manifest) error {
+	InitializeS3Session()
+	for i := range uploaders {
+		if s3TargetID(&uploaders[i]) == state.Target {
+			return uploadFileToS3(context.Background(), state.Source, state.Key, state.Database, nil, &uploaders[i], m, 0)
+		}
+	}
+	state.remove()
+	return errors.New(state.Target + " is no longer a target")
+}
+
+// abortStaleUploads aborts the multipart uploads under the bucket's path that
+// were started more than resume.abortStaleAfter hours ago. Their parts are
+// billed until then but never become an object. Uploads with a saved state
+// are left for the next run to resume.
+func abortStaleUploads(ctx context.Context, s3Instance *uploaderStruct) {
+	if params.Resume.AbortStaleAfter < 0 {
+		return
+	}
+	bucketName := s3Instance.instance.Bucket
+	cutoff := time.Now().Add(-time.Duration(params.Resume.AbortStaleAfter) * time.Hour)
+	prefix := ""
+	if s3Instance.instance.Path != "" {
+		prefix = s3Instance.instance.Path + "/"
+	}
+	saved := savedUploadIDs()
+	paginator := s3.NewListMultipartUploadsPaginator(s3Instance.client, &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(bucketName),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			logger.Error("Couldn't list unfinished uploads of " + bucketName + " - Error: " + err.Error())
+			return
+		}
+		for _, upload := range page.Uploads {
+			if upload.Initiated == nil || upload.Initiated.After(cutoff) || saved[aws.ToString(upload.UploadId)] {
+				continue
+			}
+			_, err := s3Instance.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(bucketName),
+				Key:      upload.Key,
+				UploadId: upload.UploadId,
+			})
+			if err != nil {
+				logger.Error("Couldn't abort stale upload of " + aws.ToString(upload.Key) + " in " + bucketName + " - Error: " + err.Error())
+				continue
+			}
+			logger.Info("Aborted stale upload of " + aws.ToString(upload.Key) + " in " + bucketName + ", started at " + upload.Initiated.Format(time.RFC3339))
+		}
+	}
+}
+
+func abortStaleS3Uploads() {
+	ctx := context.Background()
+	for i := range uploaders {
+		abortStaleUploads(ctx, &uploaders[i])
+	}
+}
@@ -0,0 +1,106 @@
+package backup
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"monodb-backup/config"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// sseSettings holds the server-side encryption headers of a target. SSE-S3
+// and SSE-KMS only matter when writing, SSE-C keys have to be sent with every
+// request that reads or copies the object as well.
+type sseSettings struct {
+	algorithm         types.ServerSideEncryption
+	kmsKeyID          *string
+	customerAlgorithm *string
+	customerKey       *string
+	customerKeyMD5    *string
+}
+
+func newSSESettings(sse config.ServerSideEncryption) (sseSettings, error) {
+	var s sseSettings
+	switch sse.Type {
+	case "":
+	case "AES256":
+		s.algorithm = types.ServerSideEncryptionAes256
+	case "aws:kms":
+		s.algorithm = types.ServerSideEncryptionAwsKms
+		if sse.KMSKeyID != "" {
+			s.kmsKeyID = aws.String(sse.KMSKeyID)
+		}
+	case "SSE-C":
+		key, err := base64.StdEncoding.DecodeString(sse.CustomerKey)
+		if err != nil {
+			return s, errors.New("serverSideEncryption.customerKey should be base64 encoded - " + err.Error())
+		}
+		if len(key) != 32 {
+			return s, errors.New("serverSideEncryption.customerKey should be a 256 bit key")
+		}
+		sum := md5.Sum(key)
+		s.customerAlgorithm = aws.String("AES256")
+		s.customerKey = aws.String(sse.CustomerKey)
+		s.customerKeyMD5 = aws.String(base64.StdEncoding.EncodeToString(sum[:]))
+	default:
+		return s, errors.New("unknown serverSideEncryption.type " + sse.Type + ", should be AES256, aws:kms or SSE-C")
+	}
+	return s, nil
+}
+
+func (s sseSettings) applyPut(input *s3.PutObjectInput) *s3.PutObjectInput {
+	input.ServerSideEncryption = s.algorithm
+	input.SSEKMSKeyId = s.kmsKeyID
+	input.SSECustomerAlgorithm = s.customerAlgorithm
+	input.SSECustomerKey = s.customerKey
+	input.SSECustomerKeyMD5 = s.customerKeyMD5
+	return input
+}
+
+func (s sseSettings) applyGet(input *s3.GetObjectInput) *s3.GetObjectInput {
+	input.SSECustomerAlgorithm = s.customerAlgorithm
+	input.SSECustomerKey = s.customerKey
+	input.SSECustomerKeyMD5 = s.customerKeyMD5
+	return input
+}
+
+func (s sseSettings) applyHead(input *s3.HeadObjectInput) *s3.HeadObjectInput {
+	input.SSECustomerAlgorithm = s.customerAlgorithm
+	input.SSECustomerKey = s.customerKey
+	input.SSECustomerKeyMD5 = s.customerKeyMD5
+	return input
+}
+
+func (s sseSettings) applyCopy(input *s3.CopyObjectInput) *s3.CopyObjectInput {
+	input.ServerSideEncryption = s.algorithm
+	input.SSEKMSKeyId = s.kmsKeyID
+	input.SSECustomerAlgorithm = s.customerAlgorithm
+	input.SSECustomerKey = s.customerKey
+	input.SSECustomerKeyMD5 = s.customerKeyMD5
+	input.CopySourceSSECustomerAlgorithm = s.customerAlgorithm
+	input.CopySourceSSECustomerKey = s.customerKey
+	input.CopySourceSSECustomerKeyMD5 = s.customerKeyMD5
+	return input
+}
+
+func (s sseSettings) applyCreateMultipart(input *s3.CreateMultipartUploadInput) *s3.CreateMultipartUploadInput {
+	input.ServerSideEncryption = s.algorithm
+	input.SSEKMSKeyId = s.kmsKeyID
+	input.SSECustomerAlgorithm = s.customerAlgorithm
+	input.SSECustomerKey = s.customerKey
+	input.SSECustomerKeyMD5 = s.customerKeyMD5
+	return input
+}
+
+func (s sseSettings) applyUploadPartCopy(input *s3.UploadPartCopyInput) *s3.UploadPartCopyInput {
+	input.SSECustomerAlgorithm = s.customerAlgorithm
+	input.SSECustomerKey = s.customerKey
+	input.SSECustomerKeyMD5 = s.customerKeyMD5
+	input.CopySourceSSECustomerAlgorithm = s.customerAlgorithm
+	input.CopySourceSSECustomerKey = s.customerKey
+	input.CopySourceSSECustomerKeyMD5 = s.customerKeyMD5
+	return input
+}
@@ -0,0 +1,209 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// objectFields are the names used as S3 metadata keys and, unless
+// objectTags.keys renames them, as tag keys
+var objectFields = []string{"engine", "database", "host", "tier", "codec", "encrypted", "sha256", "version"}
+
+// rotationTier returns the lower cased rotation folder of key: daily,
+// hourly, custom, weekly, monthly or none without rotation
+func rotationTier(key string) string {
+	for _, part := range strings.Split(key, "/") {
+		switch part {
+		case "Daily", "Hourly", "Custom", "Weekly", "Monthly":
+			return strings.ToLower(part)
+		}
+	}
+	return "none"
+}
+
+func objectFieldValues(m *manifest, key string) map[string]string {
+	values := map[string]string{
+		"engine":    m.Engine,
+		"database":  m.Database,
+		"host":      m.Host,
+		"tier":      rotationTier(key),
+		"codec":     m.Codec,
+		"encrypted": strconv.FormatBool(m.Encrypted),
+		"sha256":    m.SHA256,
+		"version":   m.Version,
+	}
+	for k, v := range values {
+		if v == "" {
+			delete(values, k)
+		}
+	}
+	return values
+}
+
+func s3Metadata(m *manifest, key string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	return objectFieldValues(m, key)
+}
+
+func s3TagSet(m *manifest, key string) []types.Tag {
+	if m == nil || !params.ObjectTags.Enabled {
+		return nil
+	}
+	var tags []types.Tag
+	values := objectFieldValues(m, key)
+	for _, field := range objectFields {
+		value, ok := values[field]
+		if !ok {
+			continue
+		}
+		tagKey := field
+		if renamed := params.ObjectTags.Keys[field]; renamed != "" {
+			tagKey = renamed
+		}
+		tags = append(tags, types.Tag{Key: aws.String(tagKey), Value: aws.String(value)})
+	}
+	return tags
+}
+
+// tagMap returns the tags as a map, the way Azure Blob and GCS take them
+func tagMap(m *manifest, key string) map[string]string {
+	tags := s3TagSet(m, key)
+	if len(tags) == 0 {
+		return nil
+	}
+	values := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		values[*tag.Key] = *tag.Value
+	}
+	return values
+}
+
+// s3Tagging encodes the tags the way PutObjectInput.Tagging expects them
+func s3Tagging(m *manifest, key string) *string {
+	tags := s3TagSet(m, key)
+	if len(tags) == 0 {
+		return nil
+	}
+	query := url.Values{}
+	for _, tag := range tags {
+		query.Set(*tag.Key, *tag.Value)
+	}
+	return aws.String(query.Encode())
+}
+
+// putS3Tags replaces the tags of an object, used once a streamed upload's
+// checksum is known
+func putS3Tags(ctx context.Context, s3Instance *uploaderStruct, key string, m *manifest) error {
+	tags := s3TagSet(m, key)
+	if len(tags) == 0 {
+		return nil
+	}
+	_, err := s3Instance.client.PutObjectTagging(ctx, &s3.PutObjectTaggingInput{
+		Bucket:  aws.String(s3Instance.instance.Bucket),
+		Key:     aws.String(key),
+		Tagging: &types.Tagging{TagSet: tags},
+	})
+	return err
+}
+
+// sidecarChecksum reads the sha256 of a backup from its checksum file, for
+// streamed uploads whose metadata was set before the checksum was known
+func sidecarChecksum(ctx context.Context, s3Instance *uploaderStruct, key string) string {
+	obj, err := s3Instance.client.GetObject(ctx, s3Instance.sse.applyGet(&s3.GetObjectInput{
+		Bucket: aws.String(s3Instance.instance.Bucket),
+		Key:    aws.String(key + checksumSuffix),
+	}))
+	if err != nil {
+		return ""
+	}
+	defer obj.Body.Close()
+	data, err := io.ReadAll(obj.Body)
+	if err != nil {
+		return ""
+	}
+	sum, err := parseChecksumSidecar(data)
+	if err != nil {
+		return ""
+	}
+	return sum
+}
+
+// List prints the backups stored on S3 with the metadata monodb-backup
+// attached to them. database filters by the database metadata when not empty.
+func List(database string) {
+	if params.BackupType.Type != "s3" && params.BackupType.Type != "minio" {
+		logger.Fatal("list is only supported for s3 and minio backups")
+		return
+	}
+	InitializeS3Session()
+	ctx := context.Background()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "BUCKET\tKEY\tSIZE\tMODIFIED\tDATABASE\tTIER\tCODEC\tENCRYPTED\tSHA256")
+	for i := range uploaders {
+		s3Instance := &uploaders[i]
+		bucketName := s3Instance.instance.Bucket
+		prefix := ""
+		if s3Instance.instance.Path != "" {
+			prefix = s3Instance.instance.Path + "/"
+		}
+		var objects []types.Object
+		paginator := s3.NewListObjectsV2Paginator(s3Instance.client, &s3.ListObjectsV2Input{
+			Bucket: aws.String(bucketName),
+			Prefix: aws.String(prefix),
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				logger.Error("Couldn't list bucket " + bucketName + " - Error: " + err.Error())
+				break
+			}
+			objects = append(objects, page.Contents...)
+		}
+		sort.Slice(objects, func(i, j int) bool { return *objects[i].Key < *objects[j].Key })
+
+		for _, obj := range objects {
+			if isSidecar(*obj.Key) {
+				continue
+			}
+			head, err := s3Instance.client.HeadObject(ctx, s3Instance.sse.applyHead(&s3.HeadObjectInput{
+				Bucket: aws.String(bucketName),
+				Key:    obj.Key,
+			}))
+			if err != nil {
+				logger.Error("Couldn't get metadata of " + *obj.Key + " - Error: " + err.Error())
+				continue
+			}
+			meta := head.Metadata
+			if database != "" && meta["database"] != database {
+				continue
+			}
+			var size int64
+			if obj.Size != nil {
+				size = *obj.Size
+			}
+			modified := ""
+			if obj.LastModified != nil {
+				modified = obj.LastModified.Format("2006-01-02 15:04:05")
+			}
+			sum := meta["sha256"]
+			if sum == "" {
+				sum = sidecarChecksum(ctx, s3Instance, *obj.Key)
+			}
+			fmt.Fprintln(w, bucketName+"\t"+*obj.Key+"\t"+strconv.FormatInt(size, 10)+"\t"+modified+"\t"+meta["database"]+"\t"+meta["tier"]+"\t"+meta["codec"]+"\t"+meta["encrypted"]+"\t"+sum)
+		}
+	}
+	w.Flush()
+}
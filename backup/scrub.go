@@ -0,0 +1,341 @@
+package backup
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"monodb-backup/config"
+	"monodb-backup/notify"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/pkg/sftp"
+	"google.golang.org/api/iterator"
+)
+
+// Scrub downloads every stored backup that has a checksum file, hashes it
+// again and sends an alarm for the ones that don't match anymore.
+func Scrub() {
+	logger.Info("monodb-backup scrub started.")
+	var checked int
+	var problems []string
+	switch params.BackupType.Type {
+	case "s3", "minio":
+		InitializeS3Session()
+		ctx := context.Background()
+		for i := range uploaders {
+			n, p := scrubS3(ctx, &uploaders[i])
+			checked += n
+			problems = append(problems, p...)
+		}
+	case "sftp", "rsync":
+		for _, target := range params.BackupType.Info[0].Targets {
+			n, p := scrubSFTP(target)
+			checked += n
+			problems = append(problems, p...)
+		}
+	case "azure":
+		InitializeAzure()
+		ctx := context.Background()
+		for i := range azureTargets {
+			n, p := scrubAzure(ctx, &azureTargets[i])
+			checked += n
+			problems = append(problems, p...)
+		}
+	case "gcs":
+		InitializeGCS()
+		ctx := context.Background()
+		for i := range gcsTargets {
+			n, p := scrubGCS(ctx, &gcsTargets[i])
+			checked += n
+			problems = append(problems, p...)
+		}
+	case "webdav":
+		InitializeWebDAV()
+		ctx := context.Background()
+		for i := range webdavTargets {
+			n, p := scrubWebDAV(ctx, &webdavTargets[i])
+			checked += n
+			problems = append(problems, p...)
+		}
+	case "ftp":
+		for _, target := range params.BackupType.Info[0].Targets {
+			n, p := scrubFTP(target)
+			checked += n
+			problems = append(problems, p...)
+		}
+	case "filesystem":
+		for _, info := range params.BackupType.Info {
+			n, p := scrubFilesystem(info.Path)
+			checked += n
+			problems = append(problems, p...)
+		}
+	default:
+		// nothing verified must not read as a clean scrub
+		logger.Error("Scrub isn't supported for backup type " + params.BackupType.Type)
+		problems = append(problems, "scrub isn't supported for backup type "+params.BackupType.Type)
+	}
+
+	if len(problems) > 0 {
+		notify.SendAlarm("Scrub found problems with the following backups:\n- "+strings.Join(problems, "\n- "), true)
+	} else {
+		notify.SendAlarm("Scrub verified "+strconv.Itoa(checked)+" backups.", false)
+	}
+	logger.Info("monodb-backup scrub finished. Verified " + strconv.Itoa(checked) + " backups, " + strconv.Itoa(len(problems)) + " problems.")
+}
+
+func scrubS3(ctx context.Context, s3Instance *uploaderStruct) (int, []string) {
+	bucketName := s3Instance.instance.Bucket
+	prefix := ""
+	if s3Instance.instance.Path != "" {
+		prefix = s3Instance.instance.Path + "/"
+	}
+
+	var keys []string
+	paginator := s3.NewListObjectsV2Paginator(s3Instance.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucketName),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			logger.Error("Couldn't list bucket " + bucketName + " for scrubbing - Error: " + err.Error())
+			return 0, []string{bucketName + " - " + err.Error()}
+		}
+		for _, obj := range page.Contents {
+			keys = append(keys, *obj.Key)
+		}
+	}
+
+	readObject := func(key string) (io.ReadCloser, error) {
+		obj, err := s3Instance.client.GetObject(ctx, s3Instance.sse.applyGet(&s3.GetObjectInput{
+			Bucket: aws.String(bucketName),
+			Key:    aws.String(key),
+		}))
+		if err != nil {
+			return nil, err
+		}
+		return obj.Body, nil
+	}
+	return scrubListed(bucketName+"/", keys, readObject)
+}
+
+// scrubListed verifies the listed files that have a checksum file next to
+// them. location is put before their names in messages.
+func scrubListed(location string, names []string, open func(string) (io.ReadCloser, error)) (int, []string) {
+	var checked int
+	var problems []string
+	listed := make(map[string]bool)
+	for _, name := range names {
+		listed[name] = true
+	}
+	for _, name := range names {
+		if !strings.HasSuffix(name, checksumSuffix) || !listed[sidecarOwner(name)] {
+			continue
+		}
+		artifact := sidecarOwner(name)
+		if err := scrubArtifact(artifact, name, open); err != nil {
+			logger.Error("Scrub failed for " + location + artifact + " - Error: " + err.Error())
+			problems = append(problems, location+artifact+" - "+err.Error())
+			continue
+		}
+		checked++
+	}
+	return checked, problems
+}
+
+func scrubAzure(ctx context.Context, target *azureStruct) (int, []string) {
+	prefix := ""
+	if target.instance.Path != "" {
+		prefix = target.instance.Path + "/"
+	}
+	var names []string
+	pager := target.container.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{Prefix: to.Ptr(prefix)})
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			logger.Error("Couldn't list container " + target.instance.Bucket + " for scrubbing - Error: " + err.Error())
+			return 0, []string{azureTargetID(target) + " - " + err.Error()}
+		}
+		for _, item := range page.Segment.BlobItems {
+			if item.Name != nil {
+				names = append(names, *item.Name)
+			}
+		}
+	}
+	readBlob := func(name string) (io.ReadCloser, error) {
+		resp, err := target.container.NewBlobClient(name).DownloadStream(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		return resp.Body, nil
+	}
+	return scrubListed(azureTargetID(target)+"/", names, readBlob)
+}
+
+func scrubGCS(ctx context.Context, target *gcsStruct) (int, []string) {
+	prefix := ""
+	if target.instance.Path != "" {
+		prefix = target.instance.Path + "/"
+	}
+	var names []string
+	it := target.bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			logger.Error("Couldn't list bucket " + target.instance.Bucket + " for scrubbing - Error: " + err.Error())
+			return 0, []string{gcsTargetID(target) + " - " + err.Error()}
+		}
+		names = append(names, attrs.Name)
+	}
+	readObject := func(name string) (io.ReadCloser, error) {
+		return target.bucket.Object(name).NewReader(ctx)
+	}
+	return scrubListed(gcsTargetID(target)+"/", names, readObject)
+}
+
+func scrubWebDAV(ctx context.Context, target *webdavStruct) (int, []string) {
+	files, err := target.walk(ctx, target.instance.Path)
+	if err != nil {
+		logger.Error("Couldn't list " + target.root + " for scrubbing - Error: " + err.Error())
+		return 0, []string{target.root + " - " + err.Error()}
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Path)
+	}
+	readFile := func(name string) (io.ReadCloser, error) {
+		resp, err := target.do(ctx, http.MethodGet, target.url(name), nil, 0, nil)
+		if err != nil {
+			return nil, err
+		}
+		return resp.Body, nil
+	}
+	return scrubListed(target.root+"/", names, readFile)
+}
+
+func scrubFTP(target config.Target) (int, []string) {
+	conn, err := ConnectToFTP(target)
+	if err != nil {
+		return 0, []string{target.Host + " - " + err.Error()}
+	}
+	defer conn.Quit()
+	// the listing is done before any download, an FTP connection runs one
+	// transfer at a time
+	files, err := ftpWalk(conn, target.Path)
+	if err != nil {
+		logger.Error("Couldn't list " + target.Host + ":" + target.Path + " for scrubbing - Error: " + err.Error())
+		return 0, []string{target.Host + " - " + err.Error()}
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Path)
+	}
+	readFile := func(name string) (io.ReadCloser, error) {
+		return conn.Retr(name)
+	}
+	return scrubListed(target.Host+":", names, readFile)
+}
+
+func scrubFilesystem(root string) (int, []string) {
+	var names []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// skip directories and copies that are still being written
+		if !d.IsDir() && !strings.Contains(d.Name(), ".tmp-") {
+			names = append(names, path)
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Error("Couldn't list " + root + " for scrubbing - Error: " + err.Error())
+		return 0, []string{root + " - " + err.Error()}
+	}
+	readFile := func(name string) (io.ReadCloser, error) {
+		return os.Open(name)
+	}
+	return scrubListed("", names, readFile)
+}
+
+func scrubSFTP(target config.Target) (int, []string) {
+	var checked int
+	var problems []string
+	client, err := ConnectToSSH(target)
+	if err != nil {
+		logger.Error("Couldn't connect to " + target.Host + " for scrubbing - Error: " + err.Error())
+		return checked, append(problems, target.Host+" - "+err.Error())
+	}
+	defer client.Close()
+	sftpCli, err := sftp.NewClient(client)
+	if err != nil {
+		logger.Error("Couldn't create an SFTP client for " + target.Host + " - Error: " + err.Error())
+		return checked, append(problems, target.Host+" - "+err.Error())
+	}
+	defer sftpCli.Close()
+
+	readFile := func(path string) (io.ReadCloser, error) {
+		return sftpCli.Open(path)
+	}
+
+	walker := sftpCli.Walk(target.Path)
+	for walker.Step() {
+		if walker.Err() != nil || walker.Stat().IsDir() || !strings.HasSuffix(walker.Path(), checksumSuffix) {
+			continue
+		}
+		artifact := sidecarOwner(walker.Path())
+		if _, err := sftpCli.Stat(artifact); err != nil {
+			continue
+		}
+		if err := scrubArtifact(artifact, walker.Path(), readFile); err != nil {
+			logger.Error("Scrub failed for " + target.Host + ":" + artifact + " - Error: " + err.Error())
+			problems = append(problems, target.Host+":"+artifact+" - "+err.Error())
+			continue
+		}
+		checked++
+	}
+	return checked, problems
+}
+
+func scrubArtifact(artifact, checksumFile string, open func(string) (io.ReadCloser, error)) error {
+	r, err := open(checksumFile)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	expected, err := parseChecksumSidecar(data)
+	if err != nil {
+		return err
+	}
+
+	r, err = open(artifact)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	actual, _, err := hashReader(r)
+	if err != nil {
+		return err
+	}
+	if actual != expected {
+		return checksumMismatch(artifact, expected, actual)
+	}
+	logger.Info("Verified " + artifact + ", sha256: " + actual)
+	return nil
+}
@@ -1,19 +1,35 @@
 package backup
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
 	"monodb-backup/config"
-	"net"
 	"os"
-	"regexp"
+	"path"
+	"strconv"
 	"strings"
 
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
-	"golang.org/x/crypto/ssh/agent"
 )
 
-func SendSFTP(srcPath, dstPath, db string, target config.Target) error {
-	dstPath = target.Path + "/" + nameWithPath(dstPath)
+func SendSFTP(srcPath, dstPath, db string, target config.Target, m *manifest) error {
+	return sendSFTP(srcPath, target.Path+"/"+nameWithPath(dstPath), db, target, m)
+}
+
+func resumeSFTPUpload(state *uploadState, m *manifest) error {
+	for _, target := range params.BackupType.Info[0].Targets {
+		if sftpTargetID(target) == state.Target {
+			return sendSFTP(state.Source, state.Key, state.Database, target, m)
+		}
+	}
+	state.remove()
+	return errors.New(state.Target + " is no longer a target")
+}
+
+func sendSFTP(srcPath, dstPath, db string, target config.Target, m *manifest) error {
 	logger.Info("SFTP transfer started.\n Source: " + srcPath + " - Destination: " + target.Host + ":" + dstPath)
 	client, err := ConnectToSSH(target)
 	if err != nil {
@@ -54,7 +70,28 @@ func SendSFTP(srcPath, dstPath, db string, target config.Target) error {
 		}
 	}()
 
-	err = sendOverSFTP(srcPath, dstPath, src, target, sftpCli)
+	err = sendOverSFTP(srcPath, dstPath, db, src, target, sftpCli)
+	if err != nil {
+		return err
+	}
+	return finishSFTP(client, sftpCli, dstPath, db, target, m, func(newDst string) error {
+		if _, err := src.Seek(0, io.SeekStart); err != nil {
+			logger.Error("Couldn't rewind source file " + srcPath + " - Error: " + err.Error())
+			return err
+		}
+		return sendOverSFTP(srcPath, newDst, db, src, target, sftpCli)
+	})
+}
+
+// finishSFTP verifies an upload, writes its sidecars, creates the rotation
+// copy and runs the cleanup. resend uploads the dump again when it can't be
+// copied on the server.
+func finishSFTP(client *ssh.Client, sftpCli *sftp.Client, dstPath, db string, target config.Target, m *manifest, resend func(newDst string) error) error {
+	err := verifySFTPUpload(dstPath, m, target, sftpCli)
+	if err != nil {
+		return err
+	}
+	err = writeSidecarsSFTP(dstPath, m, target, sftpCli)
 	if err != nil {
 		return err
 	}
@@ -67,7 +104,21 @@ func SendSFTP(srcPath, dstPath, db string, target config.Target) error {
 				newDst = newDst + "." + extension[i]
 			}
 			newDst = target.Path + "/" + newDst
-			err = sendOverSFTP(srcPath, newDst, src, target, sftpCli)
+			err = copyOnRemote(client, dstPath, newDst)
+			if err != nil {
+				logger.Error("Couldn't copy " + target.Host + ":" + dstPath + " to " + newDst + " on the server, sending it again - Error: " + err.Error())
+				err = resend(newDst)
+				if err != nil {
+					return err
+				}
+			} else {
+				logger.Info("Successfully copied " + target.Host + ":" + dstPath + " to " + newDst + " for rotation")
+			}
+			err = verifySFTPUpload(newDst, m, target, sftpCli)
+			if err != nil {
+				return err
+			}
+			err = writeSidecarsSFTP(newDst, m, target, sftpCli)
 			if err != nil {
 				return err
 			}
@@ -104,6 +155,9 @@ func CleanupSFTP(target config.Target, client *sftp.Client, db string) error {
 				recurseDirs = append(recurseDirs, f.Name())
 				continue
 			}
+			if strings.HasPrefix(f.Name(), ".") {
+				continue
+			}
 			backups = append(backups, BackupFile{
 				Name: f.Name(),
 				Time: f.ModTime(),
@@ -118,7 +172,7 @@ func CleanupSFTP(target config.Target, client *sftp.Client, db string) error {
 				continue
 			}
 			for _, f := range subFiles {
-				if !f.IsDir() {
+				if !f.IsDir() && !strings.HasPrefix(f.Name(), ".") {
 					backups = append(backups, BackupFile{
 						Name: f.Name(),
 						Time: f.ModTime(),
@@ -128,28 +182,7 @@ func CleanupSFTP(target config.Target, client *sftp.Client, db string) error {
 			}
 		}
 
-		var toDelete []BackupFile
-
-		re := regexp.MustCompile(`(.+)-(week_\d+|Jan|Feb|Mar|Apr|May|Jun|Jul|Aug|Sep|Oct|Nov|Dec|Mon|Tue|Wed|Thu|Fri|Sat|Sun)`)
-
-		grouped := make(map[string][]BackupFile)
-		for _, f := range backups {
-			parts := strings.Split(f.Name, "/")
-			filename := parts[len(parts)-1]
-
-			dbName := ""
-			matches := re.FindStringSubmatch(filename)
-			if len(matches) > 1 {
-				dbName = matches[1]
-			} else {
-				dbName = filename
-			}
-			grouped[dbName] = append(grouped[dbName], f)
-		}
-
-		for _, group := range grouped {
-			toDelete = append(toDelete, getFilesToDelete(group, period, keep)...)
-		}
+		toDelete := selectExpired(backups, period, keep)
 		for _, f := range toDelete {
 			err := client.Remove(f.Path)
 			if err != nil {
@@ -179,7 +212,7 @@ func CleanupSFTP(target config.Target, client *sftp.Client, db string) error {
 	return nil
 }
 
-func sendOverSFTP(srcPath, dstPath string, src *os.File, target config.Target, sftpCli *sftp.Client) error {
+func sendOverSFTP(srcPath, dstPath, db string, src *os.File, target config.Target, sftpCli *sftp.Client) error {
 	fullPath := strings.Split(dstPath, "/")
 	newPath := "/"
 	for i := 0; i < len(fullPath)-1; i++ {
@@ -191,26 +224,60 @@ func sendOverSFTP(srcPath, dstPath string, src *os.File, target config.Target, s
 		// notify.SendAlarm("Couldn't upload backup "+srcPath+" to "+target.Host+":"+dstPath+"\nCouldn't create folders "+newPath+" - Error: "+err.Error(), true)
 		return err
 	}
-	dst, err := sftpCli.Create(dstPath)
+	// a resumable upload is written to a temporary file so that a partial one
+	// is never taken for a backup, and renamed once it is complete
+	writePath := dstPath
+	dst, state := resumeSFTPFile(srcPath, dstPath, target, sftpCli)
+	if dst == nil {
+		state = newUploadState("sftp", sftpTargetID(target), dstPath, srcPath, db)
+		if state != nil {
+			writePath = sftpPartPath(dstPath)
+		}
+		dst, err = sftpCli.Create(writePath)
+		if err != nil {
+			logger.Error("Couldn't create file " + writePath + " - Error: " + err.Error())
+			// notify.SendAlarm("Couldn't upload backup "+srcPath+" to "+target.Host+":"+dstPath+"\nCouldn't create file "+dstPath+" - Error: "+err.Error(), true)
+			return err
+		}
+		logger.Info("Created destination file " + writePath + " Now starting copying")
+	} else {
+		writePath = sftpPartPath(dstPath)
+	}
+
+	throttle, err := newThrottle(target.Bandwidth)
 	if err != nil {
-		logger.Error("Couldn't create file " + dstPath + " - Error: " + err.Error())
-		// notify.SendAlarm("Couldn't upload backup "+srcPath+" to "+target.Host+":"+dstPath+"\nCouldn't create file "+dstPath+" - Error: "+err.Error(), true)
+		dst.Close()
+		logger.Error("Invalid bandwidth settings for " + target.Host + " - Error: " + err.Error())
 		return err
 	}
-	defer func() {
-		err = dst.Close()
-		if err != nil {
-			logger.Error("Couldn't close destination file: " + dstPath + " - Error: " + err.Error())
-			// notify.SendAlarm("Couldn't close destination file: "+dstPath+" - Error: "+err.Error(), true)
+	if state != nil {
+		// written in order so that the saved offset is always safe to resume from
+		if _, err = src.Seek(state.Offset, io.SeekStart); err == nil {
+			state.save()
+			_, err = io.CopyBuffer(&progressWriter{w: dst, state: state, saved: state.Offset}, throttle.reader(src), make([]byte, 1024*1024))
 		}
-	}()
-	logger.Info("Created destination file " + dstPath + " Now starting copying")
-
-	if _, err := dst.ReadFrom(src); err != nil {
-		logger.Error("Couldn't read from file " + srcPath + " to write at " + dstPath + " - Error: " + err.Error())
+	} else {
+		_, err = dst.ReadFrom(throttle.reader(src))
+	}
+	if closeErr := dst.Close(); closeErr != nil {
+		logger.Error("Couldn't close destination file: " + writePath + " - Error: " + closeErr.Error())
+		// notify.SendAlarm("Couldn't close destination file: "+dstPath+" - Error: "+err.Error(), true)
+		if err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		logger.Error("Couldn't read from file " + srcPath + " to write at " + writePath + " - Error: " + err.Error())
 		// notify.SendAlarm("Couldn't upload backup "+srcPath+" to "+target.Host+":"+dstPath+"\nCouldn't read from file "+srcPath+" to write at "+dstPath+" - Error: "+err.Error(), true)
 		return err
 	}
+	if writePath != dstPath {
+		if err := renameSFTP(sftpCli, writePath, dstPath); err != nil {
+			logger.Error("Couldn't rename " + writePath + " to " + dstPath + " - Error: " + err.Error())
+			return err
+		}
+	}
+	state.remove()
 	message := "Successfully copied " + srcPath + " to " + target.Host + ":" + dstPath
 	logger.Info(message)
 	// notify.SendAlarm(message, false)
@@ -218,31 +285,254 @@ func sendOverSFTP(srcPath, dstPath string, src *os.File, target config.Target, s
 	return nil
 }
 
-func ConnectToSSH(target config.Target) (*ssh.Client, error) {
-	port := target.Port
-	if port == "" {
-		port = "22"
+// sftpPartPath is the hidden temporary file an upload to dstPath is written to
+func sftpPartPath(dstPath string) string {
+	dir, base := path.Split(dstPath)
+	return dir + "." + base + ".part"
+}
+
+// resumeSFTPFile opens the partial upload of an earlier run positioned at its
+// saved offset. Returns nil if there is nothing to resume.
+func resumeSFTPFile(srcPath, dstPath string, target config.Target, sftpCli *sftp.Client) (*sftp.File, *uploadState) {
+	state := loadUploadState(sftpTargetID(target), dstPath, srcPath)
+	if state == nil || state.Offset == 0 {
+		return nil, nil
 	}
-	sock, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+	dst, err := sftpCli.OpenFile(sftpPartPath(dstPath), os.O_WRONLY)
 	if err != nil {
-		logger.Error("Couldn't get environment variable SSH_AUTH_SOCK - Error: " + err.Error())
-		return nil, err
+		return nil, nil
+	}
+	// anything past the saved offset may not have been written in full
+	if err := dst.Truncate(state.Offset); err != nil {
+		dst.Close()
+		return nil, nil
 	}
+	if _, err := dst.Seek(state.Offset, io.SeekStart); err != nil {
+		dst.Close()
+		return nil, nil
+	}
+	logger.Info("Resuming the upload of " + srcPath + " to " + target.Host + ":" + dstPath + " at " + strconv.FormatInt(state.Offset, 10) + " bytes")
+	return dst, state
+}
 
-	sockAgent := agent.NewClient(sock)
+// progressWriter saves the upload state every progressInterval bytes
+type progressWriter struct {
+	w     io.Writer
+	state *uploadState
+	saved int64
+}
+
+const progressInterval = 64 * 1024 * 1024
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.state.Offset += int64(n)
+	if p.state.Offset-p.saved >= progressInterval {
+		p.state.save()
+		p.saved = p.state.Offset
+	}
+	return n, err
+}
 
-	signers, err := sockAgent.Signers()
+// verifySFTPUpload compares the size of the uploaded file and, with
+// checksum.verifyUpload, reads it back to compare its SHA-256.
+func verifySFTPUpload(dstPath string, m *manifest, target config.Target, sftpCli *sftp.Client) error {
+	if m == nil || m.SHA256 == "" {
+		return nil
+	}
+	info, err := sftpCli.Stat(dstPath)
+	if err != nil {
+		logger.Error("Couldn't stat " + target.Host + ":" + dstPath + " - Error: " + err.Error())
+		return err
+	}
+	if info.Size() != m.Size {
+		err = errors.New("size mismatch for " + target.Host + ":" + dstPath + " - expected: " + strconv.FormatInt(m.Size, 10) + " got: " + strconv.FormatInt(info.Size(), 10))
+		logger.Error(err.Error())
+		return err
+	}
+	if !params.Checksum.VerifyUpload {
+		return nil
+	}
+	f, err := sftpCli.Open(dstPath)
+	if err != nil {
+		logger.Error("Couldn't open " + target.Host + ":" + dstPath + " to verify - Error: " + err.Error())
+		return err
+	}
+	defer f.Close()
+	actual, _, err := hashReader(f)
+	if err != nil {
+		logger.Error("Couldn't read " + target.Host + ":" + dstPath + " to verify - Error: " + err.Error())
+		return err
+	}
+	if actual != m.SHA256 {
+		err = checksumMismatch(target.Host+":"+dstPath, m.SHA256, actual)
+		logger.Error(err.Error())
+		return err
+	}
+	logger.Info("Verified " + target.Host + ":" + dstPath + ", sha256: " + actual)
+	return nil
+}
+
+func writeSidecarsSFTP(dstPath string, m *manifest, target config.Target, sftpCli *sftp.Client) error {
+	for _, sc := range m.sidecars(dstPath) {
+		dst, err := sftpCli.Create(dstPath + sc.suffix)
+		if err != nil {
+			logger.Error("Couldn't create file " + target.Host + ":" + dstPath + sc.suffix + " - Error: " + err.Error())
+			return err
+		}
+		_, err = dst.Write(sc.data)
+		if closeErr := dst.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			logger.Error("Couldn't write file " + target.Host + ":" + dstPath + sc.suffix + " - Error: " + err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// copyOnRemote runs cp on the target so that rotation copies don't have to
+// be sent again. Servers that only allow SFTP make it fail.
+func copyOnRemote(client *ssh.Client, src, dst string) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	if err := session.Run(remoteCopyCommand(src, dst)); err != nil {
+		return errors.New(err.Error() + " " + stderr.String())
+	}
+	return nil
+}
+
+func remoteCopyCommand(src, dst string) string {
+	return "mkdir -p " + shellQuote(path.Dir(dst)) + " && cp " + shellQuote(src) + " " + shellQuote(dst)
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func ConnectToSSH(target config.Target) (*ssh.Client, error) {
+	auths, closeAgent, err := sshAuthMethods(target)
 	if err != nil {
-		logger.Error("Couldn't get signers for ssh keys - Error: " + err.Error())
 		return nil, err
 	}
-	auths := []ssh.AuthMethod{ssh.PublicKeys(signers...)}
+	defer closeAgent()
+	hostKey, algorithms, err := hostKeyCallback(target)
+	if err != nil {
+		logger.Error("Couldn't set up host key verification for " + target.Host + " - Error: " + err.Error())
+		return nil, err
+	}
 
 	sshConfig := &ssh.ClientConfig{
-		User:            target.User,
-		Auth:            auths,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		User:              target.User,
+		Auth:              auths,
+		HostKeyCallback:   hostKey,
+		HostKeyAlgorithms: algorithms,
 	}
 
-	return ssh.Dial("tcp", target.Host+":"+port, sshConfig)
+	client, err := ssh.Dial("tcp", sshAddress(target), sshConfig)
+	if err != nil {
+		logger.Error("Couldn't connect to " + target.Host + " - Error: " + err.Error())
+	}
+	return client, err
+}
+
+func sftpStreamTargets(db, name string, m *manifest) []streamTarget {
+	var targets []streamTarget
+	for _, target := range params.BackupType.Info[0].Targets {
+		dst := target.Path + "/" + name
+		targets = append(targets, streamTarget{
+			name: target.Host,
+			upload: func(ctx context.Context, r io.Reader) error {
+				return streamSFTP(ctx, dst, db, r, target, m)
+			},
+		})
+	}
+	return targets
+}
+
+// streamSFTP writes a dump to a hidden temporary file while it is being
+// dumped and renames it once it is complete, so that an interrupted dump is
+// never taken for a backup
+func streamSFTP(ctx context.Context, dstPath, db string, r io.Reader, target config.Target, m *manifest) error {
+	logger.Info("SFTP stream started.\n Source: " + db + " - Destination: " + target.Host + ":" + dstPath)
+	client, err := ConnectToSSH(target)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	// a write blocked on a server that stopped responding only returns once
+	// the connection is closed
+	stop := context.AfterFunc(ctx, func() { client.Close() })
+	defer stop()
+	sftpCli, err := sftp.NewClient(client)
+	if err != nil {
+		logger.Error("Couldn't create an SFTP client - Error: " + err.Error())
+		return err
+	}
+	defer sftpCli.Close()
+
+	if err := writeSFTPAtomic(dstPath, r, target, sftpCli); err != nil {
+		logger.Error("Couldn't stream " + db + " to " + target.Host + ":" + dstPath + " - Error: " + err.Error())
+		return err
+	}
+	logger.Info("Successfully streamed " + db + " to " + target.Host + ":" + dstPath)
+
+	return finishSFTP(client, sftpCli, dstPath, db, target, m, func(newDst string) error {
+		// the dump is gone by now, it is read back from the server instead
+		src, err := sftpCli.Open(dstPath)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		return writeSFTPAtomic(newDst, src, target, sftpCli)
+	})
+}
+
+func writeSFTPAtomic(dstPath string, r io.Reader, target config.Target, sftpCli *sftp.Client) error {
+	dir, _ := path.Split(dstPath)
+	if err := sftpCli.MkdirAll(dir); err != nil {
+		return err
+	}
+	tmpPath := sftpPartPath(dstPath)
+	tmp, err := sftpCli.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	throttle, err := newThrottle(target.Bandwidth)
+	if err == nil {
+		// not tmp.ReadFrom, it takes io.ErrUnexpectedEOF from the reader for
+		// the end of the file and would complete a failed dump. Large writes
+		// are still sent concurrently.
+		_, err = io.CopyBuffer(struct{ io.Writer }{tmp}, throttle.reader(r), make([]byte, 1024*1024))
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = renameSFTP(sftpCli, tmpPath, dstPath)
+	}
+	if err != nil {
+		if removeErr := sftpCli.Remove(tmpPath); removeErr != nil {
+			logger.Error("Couldn't remove incomplete file " + target.Host + ":" + tmpPath + " - Error: " + removeErr.Error())
+		}
+		return err
+	}
+	return nil
+}
+
+// renameSFTP replaces dst, plain SFTP rename fails if it exists
+func renameSFTP(sftpCli *sftp.Client, src, dst string) error {
+	if _, ok := sftpCli.HasExtension("posix-rename@openssh.com"); ok {
+		return sftpCli.PosixRename(src, dst)
+	}
+	if err := sftpCli.Remove(dst); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return sftpCli.Rename(src, dst)
 }
@@ -0,0 +1,163 @@
+package backup
+
+import (
+	"errors"
+	"monodb-backup/config"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+var defaultIdentityFiles = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// sshAuthMethods builds the fallback chain for a target: public keys from the
+// identity file, its certificate and the agent, then password and
+// keyboard-interactive. The ssh package tries each method once, so every
+// signer goes into the one public key method. The returned func closes the
+// agent connection once the handshake is done.
+func sshAuthMethods(target config.Target) ([]ssh.AuthMethod, func(), error) {
+	var signers []ssh.Signer
+	keySigners, err := identitySigners(target)
+	if err != nil {
+		return nil, nil, err
+	}
+	signers = append(signers, keySigners...)
+
+	closeAgent := func() {}
+	if sockPath := os.Getenv("SSH_AUTH_SOCK"); !target.DisableAgent && sockPath != "" {
+		sock, err := net.Dial("unix", sockPath)
+		if err != nil {
+			logger.Error("Couldn't connect to the SSH agent at " + sockPath + ", skipping it - Error: " + err.Error())
+		} else {
+			closeAgent = func() { sock.Close() }
+			agentSigners, err := agent.NewClient(sock).Signers()
+			if err != nil {
+				logger.Error("Couldn't get signers from the SSH agent - Error: " + err.Error())
+			}
+			signers = append(signers, agentSigners...)
+		}
+	}
+
+	var auths []ssh.AuthMethod
+	if len(signers) > 0 {
+		auths = append(auths, ssh.PublicKeys(signers...))
+	}
+	if target.Password != "" {
+		auths = append(auths, ssh.Password(target.Password), ssh.KeyboardInteractive(passwordChallenge(target.Password)))
+	}
+	if len(auths) == 0 {
+		closeAgent()
+		err := errors.New("no SSH authentication method for " + target.Host + ", set identityFile or password, or run an ssh-agent")
+		logger.Error(err.Error())
+		return nil, nil, err
+	}
+	return auths, closeAgent, nil
+}
+
+// identitySigners loads the target's key, or the default keys of the user
+// running the backup when none is set, with the certificate signed for it
+func identitySigners(target config.Target) ([]ssh.Signer, error) {
+	files := []string{target.IdentityFile}
+	if target.IdentityFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil
+		}
+		files = nil
+		for _, name := range defaultIdentityFiles {
+			path := filepath.Join(home, ".ssh", name)
+			if _, err := os.Stat(path); err == nil {
+				files = append(files, path)
+			}
+		}
+	}
+	var signers []ssh.Signer
+	for _, file := range files {
+		signer, err := loadIdentity(file, target.Passphrase)
+		if err != nil {
+			// only a key that was asked for explicitly stops the connection
+			if target.IdentityFile != "" {
+				logger.Error("Couldn't load SSH key " + file + " - Error: " + err.Error())
+				return nil, err
+			}
+			logger.Info("Skipping SSH key " + file + ": " + err.Error())
+			continue
+		}
+		certFile := target.CertificateFile
+		if certFile == "" && target.IdentityFile != "" {
+			certFile = file + "-cert.pub"
+			if _, err := os.Stat(certFile); err != nil {
+				certFile = ""
+			}
+		}
+		if certFile != "" {
+			certSigner, err := certificateSigner(certFile, signer)
+			if err != nil {
+				logger.Error("Couldn't load SSH certificate " + certFile + " - Error: " + err.Error())
+				return nil, err
+			}
+			signers = append(signers, certSigner)
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+func loadIdentity(file, passphrase string) (ssh.Signer, error) {
+	data, err := os.ReadFile(expandHome(file))
+	if err != nil {
+		return nil, err
+	}
+	if passphrase != "" {
+		return ssh.ParsePrivateKeyWithPassphrase(data, []byte(passphrase))
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		return nil, errors.New("the key is encrypted, set passphrase")
+	}
+	return signer, err
+}
+
+func certificateSigner(file string, signer ssh.Signer) (ssh.Signer, error) {
+	data, err := os.ReadFile(expandHome(file))
+	if err != nil {
+		return nil, err
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.New(file + " is not an SSH certificate")
+	}
+	return ssh.NewCertSigner(cert, signer)
+}
+
+// passwordChallenge answers the hidden prompts of keyboard-interactive auth
+// with the password, which is what servers with PAM password auth ask for
+func passwordChallenge(password string) ssh.KeyboardInteractiveChallenge {
+	return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		for i := range questions {
+			if !echos[i] {
+				answers[i] = password
+			}
+		}
+		return answers, nil
+	}
+}
+
+func expandHome(path string) string {
+	if strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, path[2:])
+		}
+	}
+	return path
+}
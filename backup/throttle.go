@@ -0,0 +1,201 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"io"
+	"monodb-backup/config"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+type bandwidthWindow struct {
+	from, to int // minutes since midnight
+	limit    int64
+}
+
+// throttle limits a destination's upload rate. The limit is looked up again
+// on every read so uploads slow down or speed up as schedule windows start
+// and end.
+type throttle struct {
+	limit   int64
+	windows []bandwidthWindow
+}
+
+// parseRate parses bytes per second with an optional K, M or G suffix
+func parseRate(value string) (int64, error) {
+	s := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B")
+	if s == "" {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	switch s[len(s)-1] {
+	case 'K':
+		multiplier = 1024
+	case 'M':
+		multiplier = 1024 * 1024
+	case 'G':
+		multiplier = 1024 * 1024 * 1024
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid bandwidth limit " + value)
+	}
+	return n * multiplier, nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, errors.New("invalid time " + s + ", should be HH:MM")
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// newThrottle returns nil when the destination has no limits
+func newThrottle(bw config.Bandwidth) (*throttle, error) {
+	if bw.Limit == "" && len(bw.Schedule) == 0 {
+		return nil, nil
+	}
+	limit, err := parseRate(bw.Limit)
+	if err != nil {
+		return nil, err
+	}
+	t := &throttle{limit: limit}
+	for _, w := range bw.Schedule {
+		from, err := parseClock(w.From)
+		if err != nil {
+			return nil, err
+		}
+		to, err := parseClock(w.To)
+		if err != nil {
+			return nil, err
+		}
+		limit, err := parseRate(w.Limit)
+		if err != nil {
+			return nil, err
+		}
+		t.windows = append(t.windows, bandwidthWindow{from: from, to: to, limit: limit})
+	}
+	return t, nil
+}
+
+// limitAt returns the limit in bytes per second at now, 0 means unlimited
+func (t *throttle) limitAt(now time.Time) int64 {
+	if t == nil {
+		return 0
+	}
+	minute := now.Hour()*60 + now.Minute()
+	for _, w := range t.windows {
+		if w.from <= w.to && minute >= w.from && minute < w.to {
+			return w.limit
+		}
+		if w.from > w.to && (minute >= w.from || minute < w.to) {
+			return w.limit
+		}
+	}
+	return t.limit
+}
+
+// reader wraps r so that reading from it follows the limits. r is returned as
+// it is without limits, uploaders make use of io.ReaderAt when it is there.
+func (t *throttle) reader(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return t.limiter().reader(r)
+}
+
+// limiter returns the rate of one upload, for uploads that read their parts
+// concurrently. Readers of the same limiter share its limit instead of each
+// getting the whole of it.
+func (t *throttle) limiter() *uploadLimiter {
+	if t == nil {
+		return nil
+	}
+	return &uploadLimiter{throttle: t, limiter: rate.NewLimiter(rate.Inf, 0)}
+}
+
+type uploadLimiter struct {
+	throttle *throttle
+	mu       sync.Mutex
+	limiter  *rate.Limiter
+	current  int64
+}
+
+func (l *uploadLimiter) reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &throttledReader{r: r, limiter: l}
+}
+
+// burst follows the limit in effect now and returns how many bytes a read
+// may take at once, 0 means unlimited
+func (l *uploadLimiter) burst() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limit := l.throttle.limitAt(time.Now())
+	if limit != l.current {
+		l.current = limit
+		if limit == 0 {
+			l.limiter.SetLimit(rate.Inf)
+		} else {
+			// a burst of a tenth of a second keeps the rate smooth
+			burst := int(limit / 10)
+			if burst < 32*1024 {
+				burst = 32 * 1024
+			}
+			l.limiter.SetLimit(rate.Limit(limit))
+			l.limiter.SetBurst(burst)
+		}
+	}
+	if l.current == 0 {
+		return 0
+	}
+	return l.limiter.Burst()
+}
+
+type throttledReader struct {
+	r       io.Reader
+	limiter *uploadLimiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	burst := t.limiter.burst()
+	if burst > 0 && len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 && burst > 0 {
+		if waitErr := t.limiter.limiter.WaitN(context.Background(), n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
+
+// rsyncBandwidthLimit returns the value for rsync's --bwlimit, which is in
+// KiB per second and can't change during a transfer
+func rsyncBandwidthLimit(bw config.Bandwidth) (string, error) {
+	t, err := newThrottle(bw)
+	if err != nil {
+		return "", err
+	}
+	limit := t.limitAt(time.Now())
+	if limit == 0 {
+		return "", nil
+	}
+	kib := limit / 1024
+	if kib < 1 {
+		kib = 1
+	}
+	return strconv.FormatInt(kib, 10), nil
+}
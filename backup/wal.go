@@ -0,0 +1,612 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"monodb-backup/config"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/pkg/sftp"
+)
+
+// walDir holds the archived WAL, next to the backups of the cluster
+const walDir = "WAL"
+
+// ErrWALNotFound is returned by RestoreWAL for files that were never
+// archived, which PostgreSQL asks for during recovery as a matter of course
+var ErrWALNotFound = errors.New("not in the WAL archive")
+
+// baseBackupWALStart is the first WAL segment the last base backup needs,
+// recorded in its manifest so that older WAL can be deleted with it
+var baseBackupWALStart string
+
+var walSegmentName = regexp.MustCompile(`^[0-9A-F]{24}`)
+
+var backupLabelStart = regexp.MustCompile(`START WAL LOCATION: .* \(file ([0-9A-F]{24})\)`)
+
+func walArchiveSupported() error {
+	switch params.BackupType.Type {
+	case "s3", "minio", "sftp":
+		return nil
+	}
+	return errors.New("WAL archiving supports s3, minio and sftp, not " + params.BackupType.Type)
+}
+
+// walArchiveTimeout bounds one run of archive_command, PostgreSQL tries a
+// failed one again instead of waiting on a destination that stopped responding
+const walArchiveTimeout = 10 * time.Minute
+
+// walChecksumSuffix is the file next to a WAL file archived over SFTP holding
+// the sha256 of the WAL file before compression and encryption. S3 keeps it in
+// the wal-sha256 metadata.
+const walChecksumSuffix = ".wal-sha256"
+
+// ArchiveWAL is run by PostgreSQL as its archive_command with %p and %f. The
+// file is compressed and encrypted like the backups and stored under WAL/ on
+// every destination, a non-nil error makes PostgreSQL keep the file and try
+// again. A file that is already archived with the same content is left as it
+// is, one with different content is an error. Archived files are complete
+// since they are renamed or put into place at once.
+func ArchiveWAL(walPath, name string) error {
+	if err := walArchiveSupported(); err != nil {
+		return err
+	}
+	f, err := os.Open(walPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var buf bytes.Buffer
+	w, err := newArtifactWriter(&buf)
+	if err != nil {
+		return err
+	}
+	// encryption makes every artifact different, archived files are compared
+	// by the checksum of the WAL file itself
+	checksum := newChecksumWriter()
+	_, err = io.Copy(io.MultiWriter(w, checksum), f)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), walArchiveTimeout)
+	defer cancel()
+	key := walDir + "/" + name + artifactExtension()
+	switch params.BackupType.Type {
+	case "s3", "minio":
+		for _, s3Instance := range uploaders {
+			if err := archiveWALToS3(ctx, &s3Instance, key, buf.Bytes(), checksum.sum()); err != nil {
+				logger.Error("Couldn't archive " + name + " to " + s3Instance.instance.Bucket + " - Error: " + err.Error())
+				return err
+			}
+		}
+	case "sftp":
+		for _, target := range params.BackupType.Info[0].Targets {
+			if err := archiveWALToSFTP(ctx, target, key, buf.Bytes(), checksum.sum()); err != nil {
+				logger.Error("Couldn't archive " + name + " to " + target.Host + " - Error: " + err.Error())
+				return err
+			}
+		}
+	}
+	logger.Info("Archived " + name)
+	return nil
+}
+
+func errWALConflict(location string) error {
+	return errors.New(location + " is already archived with different content")
+}
+
+func archiveWALToS3(ctx context.Context, s3Instance *uploaderStruct, key string, data []byte, sum string) error {
+	if s3Instance.instance.Path != "" {
+		key = s3Instance.instance.Path + "/" + key
+	}
+	head, err := s3Instance.client.HeadObject(ctx, s3Instance.sse.applyHead(&s3.HeadObjectInput{
+		Bucket:       aws.String(s3Instance.instance.Bucket),
+		Key:          aws.String(key),
+		ChecksumMode: types.ChecksumModeEnabled,
+	}))
+	if err == nil {
+		if stored := head.Metadata["wal-sha256"]; stored != "" {
+			if stored != sum {
+				return errWALConflict(s3Instance.instance.Bucket + "/" + key)
+			}
+		} else {
+			// archived without the metadata, an unencrypted WAL file gives
+			// the same artifact again
+			artifactSum, _, _ := hashReader(bytes.NewReader(data))
+			if aws.ToInt64(head.ContentLength) != int64(len(data)) || head.ChecksumSHA256 == nil || base64ToHex(*head.ChecksumSHA256) != artifactSum {
+				return errWALConflict(s3Instance.instance.Bucket + "/" + key)
+			}
+		}
+		logger.Info(key + " is already archived in " + s3Instance.instance.Bucket)
+		return nil
+	}
+	var notFound *types.NotFound
+	if !errors.As(err, &notFound) {
+		return err
+	}
+	_, err = s3Instance.client.PutObject(ctx, s3Instance.sse.applyPut(&s3.PutObjectInput{
+		Bucket:            aws.String(s3Instance.instance.Bucket),
+		Key:               aws.String(key),
+		Body:              bytes.NewReader(data),
+		ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+		Metadata:          map[string]string{"wal-sha256": sum},
+	}))
+	return err
+}
+
+func archiveWALToSFTP(ctx context.Context, target config.Target, key string, data []byte, sum string) error {
+	client, err := ConnectToSSH(target)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	stop := context.AfterFunc(ctx, func() { client.Close() })
+	defer stop()
+	sftpCli, err := sftp.NewClient(client)
+	if err != nil {
+		return err
+	}
+	defer sftpCli.Close()
+	dst := target.Path + "/" + key
+	if info, err := sftpCli.Stat(dst); err == nil {
+		same, err := sftpWALMatches(sftpCli, dst, info.Size(), data, sum)
+		if err != nil {
+			return err
+		}
+		if !same {
+			return errWALConflict(target.Host + ":" + dst)
+		}
+		logger.Info(dst + " is already archived on " + target.Host)
+		return nil
+	}
+	// the checksum goes first so that every archived file has one
+	if err := writeSFTPAtomic(dst+walChecksumSuffix, strings.NewReader(sum+"\n"), target, sftpCli); err != nil {
+		return err
+	}
+	return writeSFTPAtomic(dst, bytes.NewReader(data), target, sftpCli)
+}
+
+// sftpWALMatches compares an archived WAL file with the one being archived by
+// the checksum next to it, or by their content for a file archived without one
+func sftpWALMatches(sftpCli *sftp.Client, dst string, size int64, data []byte, sum string) (bool, error) {
+	if f, err := sftpCli.Open(dst + walChecksumSuffix); err == nil {
+		defer f.Close()
+		stored, err := io.ReadAll(f)
+		if err != nil {
+			return false, err
+		}
+		return strings.TrimSpace(string(stored)) == sum, nil
+	}
+	if size != int64(len(data)) {
+		return false, nil
+	}
+	f, err := sftpCli.Open(dst)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	actual, _, err := hashReader(f)
+	if err != nil {
+		return false, err
+	}
+	expected, _, _ := hashReader(bytes.NewReader(data))
+	return actual == expected, nil
+}
+
+// walKeys returns the keys a WAL file may be archived under, the current
+// compression and encryption first. Files archived before these settings
+// changed keep their extensions.
+func walKeys(name string) []string {
+	keys := []string{walDir + "/" + name + artifactExtension()}
+	for _, compression := range []string{"", ".gz", ".zst", ".xz"} {
+		for _, encryption := range []string{"", ".age", ".gpg"} {
+			if key := walDir + "/" + name + compression + encryption; key != keys[0] {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+// RestoreWAL is run by PostgreSQL as its restore_command with %f and %p. The
+// file is taken from the first destination that has it.
+func RestoreWAL(name, dst, identity string) error {
+	if err := walArchiveSupported(); err != nil {
+		return err
+	}
+	keys := walKeys(name)
+	var sources []func() (io.ReadCloser, string, error)
+	switch params.BackupType.Type {
+	case "s3", "minio":
+		ctx := context.Background()
+		for _, s3Instance := range uploaders {
+			sources = append(sources, func() (io.ReadCloser, string, error) {
+				return openWALOnS3(ctx, &s3Instance, keys)
+			})
+		}
+	case "sftp":
+		for _, target := range params.BackupType.Info[0].Targets {
+			sources = append(sources, func() (io.ReadCloser, string, error) {
+				return openWALOnSFTP(target, keys)
+			})
+		}
+	}
+	// a destination that can't be reached isn't taken for a missing file,
+	// that would end the recovery early
+	var r io.ReadCloser
+	var key string
+	var err error
+	for _, open := range sources {
+		var openErr error
+		r, key, openErr = open()
+		if openErr == nil {
+			break
+		}
+		if !errors.Is(openErr, ErrWALNotFound) && err == nil {
+			err = openErr
+		}
+	}
+	if r == nil {
+		if err == nil {
+			err = ErrWALNotFound
+		}
+		return err
+	}
+	defer r.Close()
+
+	dr, err := newDecryptor(r, key, identity)
+	if err != nil {
+		return err
+	}
+	plain, err := newDecompressor(dr, trimEncryptionExtension(key))
+	if err != nil {
+		return err
+	}
+	defer plain.Close()
+	tmp := filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+".tmp")
+	if err := writeFile(plain, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// openWALOnS3 opens the first of keys found in the bucket and returns its key
+func openWALOnS3(ctx context.Context, s3Instance *uploaderStruct, keys []string) (io.ReadCloser, string, error) {
+	for _, key := range keys {
+		fullKey := key
+		if s3Instance.instance.Path != "" {
+			fullKey = s3Instance.instance.Path + "/" + key
+		}
+		obj, err := s3Instance.client.GetObject(ctx, s3Instance.sse.applyGet(&s3.GetObjectInput{
+			Bucket: aws.String(s3Instance.instance.Bucket),
+			Key:    aws.String(fullKey),
+		}))
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		return obj.Body, key, nil
+	}
+	return nil, "", ErrWALNotFound
+}
+
+// sftpFile closes the connection along with the file
+type sftpFile struct {
+	*sftp.File
+	close func()
+}
+
+func (f *sftpFile) Close() error {
+	err := f.File.Close()
+	f.close()
+	return err
+}
+
+// openWALOnSFTP opens the first of keys found on the target and returns its key
+func openWALOnSFTP(target config.Target, keys []string) (io.ReadCloser, string, error) {
+	client, err := ConnectToSSH(target)
+	if err != nil {
+		return nil, "", err
+	}
+	sftpCli, err := sftp.NewClient(client)
+	if err != nil {
+		client.Close()
+		return nil, "", err
+	}
+	closeAll := func() {
+		sftpCli.Close()
+		client.Close()
+	}
+	for _, key := range keys {
+		f, err := sftpCli.Open(target.Path + "/" + key)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			closeAll()
+			return nil, "", err
+		}
+		return &sftpFile{File: f, close: closeAll}, key, nil
+	}
+	closeAll()
+	return nil, "", ErrWALNotFound
+}
+
+// readWALStart finds the first WAL segment a tar format base backup needs in
+// the backup_label of its base.tar
+func readWALStart(dir string) (string, error) {
+	name := filepath.Join(dir, "base.tar")
+	if _, err := os.Stat(name); err != nil {
+		name += ".gz"
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(name, ".gz") {
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			return "", err
+		}
+		defer gr.Close()
+		r = gr
+	}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return "", errors.New("no backup_label in " + name)
+		}
+		if err != nil {
+			return "", err
+		}
+		if path.Clean(header.Name) != "backup_label" {
+			continue
+		}
+		label, err := io.ReadAll(tr)
+		if err != nil {
+			return "", err
+		}
+		match := backupLabelStart.FindSubmatch(label)
+		if match == nil {
+			return "", errors.New("no start WAL location in backup_label")
+		}
+		return string(match[1]), nil
+	}
+}
+
+// walExpired tells whether an archived WAL file comes before start, like
+// pg_archivecleanup the timeline is not compared. History files are kept,
+// recovery needs them to follow timelines.
+func walExpired(name, start string) bool {
+	base := path.Base(name)
+	if !walSegmentName.MatchString(base) || strings.Contains(base, ".history") {
+		return false
+	}
+	return base[8:24] < start[8:24]
+}
+
+// oldestWALStart returns the earliest WAL start recorded in the manifests of
+// the base backups that are still kept, empty if there are none or if one of
+// them has no WAL start
+func oldestWALStart(manifests []string, open func(string) (io.ReadCloser, error)) (string, error) {
+	var oldest string
+	for _, name := range manifests {
+		r, err := open(name)
+		if err != nil {
+			return "", err
+		}
+		var m manifest
+		err = json.NewDecoder(r).Decode(&m)
+		r.Close()
+		if err != nil {
+			return "", errors.New("couldn't read " + name + ": " + err.Error())
+		}
+		if !walSegmentName.MatchString(m.WALStart) {
+			// what this backup needs is unknown, so all of the WAL is kept
+			logger.Info(name + " has no WAL start, the WAL archive is not cleaned up")
+			return "", nil
+		}
+		if oldest == "" || m.WALStart[8:24] < oldest[8:24] {
+			oldest = m.WALStart
+		}
+	}
+	return oldest, nil
+}
+
+func isBaseBackupManifest(name string) bool {
+	return strings.HasPrefix(path.Base(name), pgBaseBackup+"-") && strings.HasSuffix(name, manifestSuffix)
+}
+
+// CleanupWAL deletes the archived WAL that none of the remaining base backups
+// needs. It runs after the base backups themselves have been cleaned up.
+func CleanupWAL() {
+	if walArchiveSupported() != nil || !retentionEnabled() {
+		return
+	}
+	switch params.BackupType.Type {
+	case "s3", "minio":
+		ctx := context.Background()
+		for _, s3Instance := range uploaders {
+			if err := cleanupWALOnS3(ctx, &s3Instance); err != nil {
+				logger.Error("Couldn't clean up the WAL archive in " + s3Instance.instance.Bucket + " - Error: " + err.Error())
+			}
+		}
+	case "sftp":
+		for _, target := range params.BackupType.Info[0].Targets {
+			if err := cleanupWALOnSFTP(target); err != nil {
+				logger.Error("Couldn't clean up the WAL archive on " + target.Host + " - Error: " + err.Error())
+			}
+		}
+	}
+}
+
+func cleanupWALOnS3(ctx context.Context, s3Instance *uploaderStruct) error {
+	bucketName := s3Instance.instance.Bucket
+	prefix := ""
+	if s3Instance.instance.Path != "" {
+		prefix = s3Instance.instance.Path + "/"
+	}
+	var manifests, wal []string
+	paginator := s3.NewListObjectsV2Paginator(s3Instance.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucketName),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, obj := range page.Contents {
+			key := aws.ToString(obj.Key)
+			if strings.HasPrefix(key, prefix+walDir+"/") {
+				wal = append(wal, key)
+			} else if isBaseBackupManifest(key) {
+				manifests = append(manifests, key)
+			}
+		}
+	}
+	start, err := oldestWALStart(manifests, func(key string) (io.ReadCloser, error) {
+		obj, err := s3Instance.client.GetObject(ctx, s3Instance.sse.applyGet(&s3.GetObjectInput{
+			Bucket: aws.String(bucketName),
+			Key:    aws.String(key),
+		}))
+		if err != nil {
+			return nil, err
+		}
+		return obj.Body, nil
+	})
+	if err != nil || start == "" {
+		return err
+	}
+	var objects []types.ObjectIdentifier
+	for _, key := range wal {
+		if walExpired(key, start) {
+			objects = append(objects, types.ObjectIdentifier{Key: aws.String(key)})
+		}
+	}
+	for i := 0; i < len(objects); i += 1000 {
+		end := min(i+1000, len(objects))
+		out, err := s3Instance.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(bucketName),
+			Delete: &types.Delete{Objects: objects[i:end]},
+		})
+		if err != nil {
+			return err
+		}
+		for _, e := range out.Errors {
+			logger.Info("Skipped deleting " + aws.ToString(e.Key) + " from S3 - " + aws.ToString(e.Code) + ": " + aws.ToString(e.Message))
+		}
+		logger.Info("Deleted " + strconv.Itoa(len(out.Deleted)) + " WAL files older than " + start + " from " + bucketName)
+	}
+	return nil
+}
+
+func cleanupWALOnSFTP(target config.Target) error {
+	client, err := ConnectToSSH(target)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	sftpCli, err := sftp.NewClient(client)
+	if err != nil {
+		return err
+	}
+	defer sftpCli.Close()
+
+	var manifests, wal []string
+	walker := sftpCli.Walk(target.Path)
+	for walker.Step() {
+		if walker.Err() != nil || walker.Stat().IsDir() {
+			continue
+		}
+		if path.Base(path.Dir(walker.Path())) == walDir {
+			wal = append(wal, walker.Path())
+		} else if isBaseBackupManifest(walker.Path()) {
+			manifests = append(manifests, walker.Path())
+		}
+	}
+	start, err := oldestWALStart(manifests, func(name string) (io.ReadCloser, error) {
+		return sftpCli.Open(name)
+	})
+	if err != nil || start == "" {
+		return err
+	}
+	var deleted int
+	for _, name := range wal {
+		if !walExpired(name, start) {
+			continue
+		}
+		if err := sftpCli.Remove(name); err != nil {
+			logger.Error("Couldn't delete " + target.Host + ":" + name + " - Error: " + err.Error())
+			continue
+		}
+		deleted++
+	}
+	logger.Info("Deleted " + strconv.Itoa(deleted) + " WAL files older than " + start + " from " + target.Host)
+	return nil
+}
+
+// writeRecoveryConfig sets up a restored base backup for point-in-time
+// recovery: the WAL is fetched with restore-wal and replayed up to
+// targetTime, or to the end of the archive for latest
+func writeRecoveryConfig(dataDir, configPath, identity, targetTime string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	command := shellQuote(exe)
+	if configPath != "" {
+		command += " -config " + shellQuote(configPath)
+	}
+	command += " restore-wal"
+	if identity != "" {
+		command += " -identity " + shellQuote(identity)
+	}
+	command += " %f %p"
+	settings := "\n# added by monodb-backup restore\nrestore_command = " + pgQuote(command) + "\n"
+	if targetTime != "latest" {
+		settings += "recovery_target_time = " + pgQuote(targetTime) + "\nrecovery_target_action = 'promote'\n"
+	}
+	f, err := os.OpenFile(filepath.Join(dataDir, "postgresql.auto.conf"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(settings)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dataDir, "recovery.signal"), nil, 0600)
+}
+
+// pgQuote quotes a value for postgresql.conf
+func pgQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
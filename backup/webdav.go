@@ -0,0 +1,404 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io"
+	"monodb-backup/config"
+	"monodb-backup/notify"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// nextcloudFiles is the part of a Nextcloud WebDAV endpoint before the user,
+// its chunked uploads go to the matching uploads collection
+const nextcloudFiles = "/remote.php/dav/files/"
+
+type webdavStruct struct {
+	instance  config.BackupTypeInfo
+	client    *http.Client
+	root      string
+	uploads   string // Nextcloud chunking v2 collection, empty for plain WebDAV
+	chunkSize int64
+	throttle  *throttle
+	dirs      map[string]bool
+}
+
+var webdavTargets []webdavStruct
+
+func InitializeWebDAV() {
+	if len(webdavTargets) > 0 {
+		return
+	}
+	for _, info := range params.BackupType.Info {
+		throttle, err := newThrottle(info.Bandwidth)
+		if err != nil {
+			logger.Fatal("Invalid bandwidth settings for " + info.Endpoint + ": " + err.Error())
+			return
+		}
+		tr := http.DefaultTransport.(*http.Transport).Clone()
+		if info.InsecureSkipVerify {
+			tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		}
+		chunkSize := params.PartSize * 1024 * 1024
+		if info.PartSize > 0 {
+			chunkSize = info.PartSize * 1024 * 1024
+		}
+		root := strings.TrimSuffix(info.Endpoint, "/")
+		var uploads string
+		if i := strings.Index(root, nextcloudFiles); i >= 0 {
+			user := strings.SplitN(root[i+len(nextcloudFiles):], "/", 2)[0]
+			uploads = root[:i] + "/remote.php/dav/uploads/" + user
+		}
+		webdavTargets = append(webdavTargets, webdavStruct{
+			instance:  info,
+			client:    &http.Client{Transport: tr},
+			root:      root,
+			uploads:   uploads,
+			chunkSize: chunkSize,
+			throttle:  throttle,
+			dirs:      make(map[string]bool),
+		})
+	}
+}
+
+// url returns the escaped URL of a path relative to the WebDAV root
+func (target *webdavStruct) url(path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return target.root + "/" + strings.Join(segments, "/")
+}
+
+type davStatusError struct {
+	code    int
+	message string
+}
+
+func (e *davStatusError) Error() string { return e.message }
+
+func (target *webdavStruct) do(ctx context.Context, method, rawURL string, body io.Reader, size int64, header map[string]string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	if target.instance.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+target.instance.BearerToken)
+	} else if target.instance.Username != "" {
+		req.SetBasicAuth(target.instance.Username, target.instance.Password)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := target.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, &davStatusError{code: resp.StatusCode, message: method + " " + rawURL + " returned " + resp.Status}
+	}
+	return resp, nil
+}
+
+// request is do for requests whose response body isn't needed
+func (target *webdavStruct) request(ctx context.Context, method, rawURL string, body io.Reader, size int64, header map[string]string) error {
+	resp, err := target.do(ctx, method, rawURL, body, size, header)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
+// mkdirAll creates the collections of the Daily/Mon/... layout one level at a
+// time, WebDAV has no recursive MKCOL
+func (target *webdavStruct) mkdirAll(ctx context.Context, dir string) error {
+	dir = strings.Trim(dir, "/")
+	if dir == "" || target.dirs[dir] {
+		return nil
+	}
+	parts := strings.Split(dir, "/")
+	for i := range parts {
+		current := strings.Join(parts[:i+1], "/")
+		if target.dirs[current] {
+			continue
+		}
+		err := target.request(ctx, "MKCOL", target.url(current), nil, 0, nil)
+		// 405 means the collection is already there
+		var statusErr *davStatusError
+		if err != nil && !(errors.As(err, &statusErr) && statusErr.code == http.StatusMethodNotAllowed) {
+			return err
+		}
+		target.dirs[current] = true
+	}
+	return nil
+}
+
+type davMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Prop struct {
+				LastModified  string `xml:"getlastmodified"`
+				ContentLength string `xml:"getcontentlength"`
+				ResourceType  struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+			} `xml:"prop"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+type davEntry struct {
+	path    string
+	dir     bool
+	size    int64
+	modTime time.Time
+}
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?><d:propfind xmlns:d="DAV:"><d:prop><d:getlastmodified/><d:getcontentlength/><d:resourcetype/></d:prop></d:propfind>`
+
+// propfind returns the entries of a collection with depth 1, or the path
+// itself with depth 0. Paths are relative to the WebDAV root.
+func (target *webdavStruct) propfind(ctx context.Context, path, depth string) ([]davEntry, error) {
+	resp, err := target.do(ctx, "PROPFIND", target.url(path), strings.NewReader(propfindBody), int64(len(propfindBody)), map[string]string{
+		"Depth":        depth,
+		"Content-Type": "application/xml",
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var ms davMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, err
+	}
+	rootURL, err := url.Parse(target.root)
+	if err != nil {
+		return nil, err
+	}
+	rootPath := strings.TrimSuffix(rootURL.Path, "/")
+	self := strings.Trim(path, "/")
+	var entries []davEntry
+	for _, r := range ms.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			continue
+		}
+		rel := strings.Trim(strings.TrimPrefix(href.Path, rootPath), "/")
+		if depth != "0" && rel == self {
+			continue
+		}
+		entry := davEntry{path: rel}
+		for _, ps := range r.Propstat {
+			if ps.Prop.ResourceType.Collection != nil {
+				entry.dir = true
+			}
+			if ps.Prop.ContentLength != "" {
+				entry.size, _ = strconv.ParseInt(ps.Prop.ContentLength, 10, 64)
+			}
+			if ps.Prop.LastModified != "" {
+				entry.modTime, _ = http.ParseTime(ps.Prop.LastModified)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// uploadFileToWebDAV uploads a dump with a single PUT, or in chunks on
+// Nextcloud when it is larger than the chunk size
+func uploadFileToWebDAV(ctx context.Context, src, dst, db string, target *webdavStruct, m *manifest) error {
+	file, err := os.Open(src)
+	if err != nil {
+		logger.Error("Couldn't open file " + src + " to read - Error: " + err.Error())
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		logger.Error("Couldn't get file info " + src + " - Error: " + err.Error())
+		return err
+	}
+
+	if err := target.mkdirAll(ctx, dst[:max(strings.LastIndex(dst, "/"), 0)]); err != nil {
+		logger.Error("Couldn't create directory for " + dst + " on " + target.root + "\n Error: " + err.Error())
+		return err
+	}
+	if target.uploads != "" && info.Size() > target.chunkSize {
+		err = target.uploadChunked(ctx, file, info.Size(), dst)
+	} else {
+		err = target.request(ctx, http.MethodPut, target.url(dst), target.throttle.reader(file), info.Size(), nil)
+	}
+	if err != nil {
+		logger.Error("Couldn't upload " + src + " to " + target.root + " path: " + dst + "\n Error: " + err.Error())
+		return err
+	}
+	entries, err := target.propfind(ctx, dst, "0")
+	if err == nil && (len(entries) == 0 || entries[0].size != info.Size()) {
+		err = errors.New("size mismatch for " + dst + " - expected: " + strconv.FormatInt(info.Size(), 10))
+	}
+	if err != nil {
+		logger.Error("Couldn't verify " + src + " on " + target.root + " path: " + dst + "\n Error: " + err.Error())
+		return err
+	}
+	logger.Info("Successfully uploaded " + src + " to " + target.root + " path: " + dst)
+
+	if err := putSidecarsToWebDAV(ctx, target, dst, m); err != nil {
+		return err
+	}
+
+	if params.Rotation.Enabled {
+		if db == "mysql" {
+			db = db + "_users"
+		}
+		shouldRotate, name := rotate(db, target.root)
+		if shouldRotate {
+			if target.instance.Path != "" {
+				name = target.instance.Path + "/" + name
+			}
+			extension := strings.Split(dst, ".")
+			for i := 1; i < len(extension); i++ {
+				name = name + "." + extension[i]
+			}
+			err := target.mkdirAll(ctx, name[:max(strings.LastIndex(name, "/"), 0)])
+			if err == nil {
+				err = target.request(ctx, "COPY", target.url(dst), nil, 0, map[string]string{
+					"Destination": target.url(name),
+					"Overwrite":   "T",
+				})
+			}
+			if err != nil {
+				logger.Error("Couldn't create copy of " + src + " for rotation on " + target.root + " path: " + name + "\n Error: " + err.Error())
+				return err
+			}
+			if err := putSidecarsToWebDAV(ctx, target, name, m); err != nil {
+				return err
+			}
+			updateRotatedTimestamp(db, target.root)
+			logger.Info("Successfully created a copy of " + src + " for rotation on " + target.root + " path: " + name)
+		}
+
+		if retentionEnabled() {
+			if err := cleanupWebDAV(ctx, target); err != nil {
+				logger.Error("Error during WebDAV cleanup: " + err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// uploadChunked uses Nextcloud's chunking v2: the chunks are PUT into an
+// upload collection and assembled with a MOVE of its .file to the destination
+func (target *webdavStruct) uploadChunked(ctx context.Context, file *os.File, size int64, dst string) error {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	upload := target.uploads + "/monodb-backup-" + hex.EncodeToString(id)
+	destination := map[string]string{"Destination": target.url(dst)}
+	if err := target.request(ctx, "MKCOL", upload, nil, 0, destination); err != nil {
+		return err
+	}
+	err := func() error {
+		for n, offset := 1, int64(0); offset < size; n, offset = n+1, offset+target.chunkSize {
+			length := min(target.chunkSize, size-offset)
+			chunk := target.throttle.reader(io.NewSectionReader(file, offset, length))
+			if err := target.request(ctx, http.MethodPut, upload+"/"+strconv.Itoa(n), chunk, length, destination); err != nil {
+				return err
+			}
+		}
+		return target.request(ctx, "MOVE", upload+"/.file", nil, 0, map[string]string{
+			"Destination":     target.url(dst),
+			"OC-Total-Length": strconv.FormatInt(size, 10),
+			"Overwrite":       "T",
+		})
+	}()
+	if err != nil {
+		if abortErr := target.request(context.Background(), http.MethodDelete, upload, nil, 0, nil); abortErr != nil {
+			logger.Error("Couldn't remove the chunked upload " + upload + " - Error: " + abortErr.Error())
+		}
+	}
+	return err
+}
+
+func putSidecarsToWebDAV(ctx context.Context, target *webdavStruct, dst string, m *manifest) error {
+	for _, sc := range m.sidecars(dst) {
+		err := target.request(ctx, http.MethodPut, target.url(dst+sc.suffix), bytes.NewReader(sc.data), int64(len(sc.data)), nil)
+		if err != nil {
+			logger.Error("Couldn't upload " + dst + sc.suffix + " to " + target.root + "\n Error: " + err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// walk lists the files under dir and its subcollections
+func (target *webdavStruct) walk(ctx context.Context, dir string) ([]BackupFile, error) {
+	entries, err := target.propfind(ctx, dir, "1")
+	if err != nil {
+		return nil, err
+	}
+	var backups []BackupFile
+	for _, e := range entries {
+		if !e.dir {
+			backups = append(backups, BackupFile{Name: e.path, Time: e.modTime, Path: e.path})
+			continue
+		}
+		sub, err := target.walk(ctx, e.path)
+		if err != nil {
+			return nil, err
+		}
+		backups = append(backups, sub...)
+	}
+	return backups, nil
+}
+
+func cleanupWebDAV(ctx context.Context, target *webdavStruct) error {
+	list := func(dir string) ([]BackupFile, error) {
+		if target.instance.Path != "" {
+			dir = target.instance.Path + "/" + dir
+		}
+		if _, err := target.propfind(ctx, dir, "0"); err != nil {
+			// nothing has been rotated into this folder yet
+			return nil, nil
+		}
+		return target.walk(ctx, dir)
+	}
+	remove := func(f BackupFile) error {
+		return target.request(ctx, http.MethodDelete, target.url(f.Path), nil, 0, nil)
+	}
+	return applyRetention(list, remove)
+}
+
+func uploadToWebDAV(src, dst, db string, m *manifest) {
+	ctx := context.Background()
+	for i := range webdavTargets {
+		target := &webdavTargets[i]
+		finalDst := nameWithPath(dst)
+		if target.instance.Path != "" {
+			finalDst = target.instance.Path + "/" + finalDst
+		}
+		err := uploadFileToWebDAV(ctx, src, finalDst, db, target, m)
+		if err != nil {
+			notify.FailedDBList = append(notify.FailedDBList, db+" - "+src+" - "+err.Error())
+			FailedDBNames = append(FailedDBNames, db)
+		} else {
+			notify.SuccessfulDBList = append(notify.SuccessfulDBList, db+" - "+src)
+		}
+	}
+}
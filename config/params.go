@@ -13,10 +13,12 @@ type Params struct {
 	Database          string
 	Databases         []string
 	Exclude           []string
-	Format            string // 7z, gz, default gz(pg_dump -Fc option - no further compression)
+	Format            string // 7z, gz, default gz(pg_dump -Fc option - no further compression) - superseded by Compression
+	Compression       Compression
 	BackupAsTables    bool
 	RemoveLocal       bool
 	ArchivePass       string
+	Encryption        Encryption
 	CtxCancel         uint8
 	Base64            bool // Remote.Host, Remote.User, Remote.Password, Target.Host, Target.Password
 	Rotation          Rotation
@@ -25,6 +27,11 @@ type Params struct {
 	BackupType        BackupType
 	Retry             bool
 	PartSize          int64
+	Streaming         Streaming
+	Resume            Resume
+	Checksum          Checksum
+	ObjectTags        ObjectTags
+	PostgreSQL        PostgreSQL
 	Notify            struct {
 		UptimeAlarm      bool
 		UptimeStartLimit int
@@ -56,14 +63,137 @@ type BackupTypeInfo struct {
 	Secure             bool
 	InsecureSkipVerify bool
 	Targets            []Target
+
+	ServerSideEncryption ServerSideEncryption
+	ObjectLock           ObjectLock
+	Bandwidth            Bandwidth
+	Concurrency          int   // parallel part uploads, 10 if 0
+	PartSize             int64 // in MB, the global partSize if 0
+
+	// azure: bucket is the container, accessKey and secretKey the storage
+	// account's name and key unless one of these is given
+	SASToken         string
+	ConnectionString string
+	AccessTier       string // Hot, Cool, Cold or Archive
+
+	// gcs: bucket and path as above, credentials from the service account
+	// JSON file or the environment's default credentials if empty
+	CredentialsFile string
+	StorageClass    string // STANDARD, NEARLINE, COLDLINE or ARCHIVE
+
+	// webdav: endpoint is the WebDAV root, a Nextcloud endpoint such as
+	// https://cloud.example.com/remote.php/dav/files/<user> also gets chunked
+	// uploads. Basic auth unless a bearer token is given.
+	Username    string
+	Password    string
+	BearerToken string
+
+	// filesystem: path is a mounted directory such as an NFS share
+	HardLink bool // hard link rotation copies instead of copying them
+}
+
+// Bandwidth limits are in bytes per second with an optional K, M or G suffix
+type Bandwidth struct {
+	Limit    string
+	Schedule []BandwidthWindow // overrides Limit between From and To
+}
+
+type BandwidthWindow struct {
+	From  string // 08:00
+	To    string // 18:00, before From for windows that span midnight
+	Limit string
+}
+
+type ObjectLock struct {
+	Enabled bool
+	Mode    string            // GOVERNANCE or COMPLIANCE
+	Tiers   map[string]string // mode per tier (daily, hourly, custom, weekly, monthly), off disables locking for the tier
+}
+
+type ServerSideEncryption struct {
+	Type        string // AES256 (SSE-S3), aws:kms (SSE-KMS) or SSE-C
+	KMSKeyID    string // for aws:kms, bucket's default key if empty
+	CustomerKey string // for SSE-C, base64 encoded 256 bit key
 }
 
 type Target struct {
-	User  string
-	Flags string
-	Host  string
-	Port  string
-	Path  string
+	User      string
+	Flags     string
+	Host      string
+	Port      string
+	Path      string
+	Bandwidth Bandwidth
+
+	// ftp and sftp
+	Password string
+
+	// ftp
+	TLS                string // explicit (AUTH TLS) or implicit, plain FTP if empty
+	InsecureSkipVerify bool
+
+	// sftp: the key file, its certificate and the agent are offered in this
+	// order, then the password for password and keyboard-interactive auth
+	IdentityFile    string // ~/.ssh/id_ed25519, id_ecdsa and id_rsa if empty
+	Passphrase      string
+	CertificateFile string // <identityFile>-cert.pub if it exists
+	DisableAgent    bool
+
+	// sftp and rsync host key verification, also passed to ssh and rsync
+	KnownHostsFile     string // ~/.ssh/known_hosts if empty
+	HostKeyFingerprint string // SHA256:... pins the host key instead of known_hosts
+	HostKeyCheck       string // yes (default), accept-new records unknown keys, no skips the check
+
+	// rsync, flags are split like a shell would and default to -a
+	Mkpath    bool   // create the path with --mkpath (rsync 3.2.3+ on both ends) instead of mkdir in --rsync-path
+	RsyncPath string // rsync on the target, rsync if empty
+}
+
+type Compression struct {
+	Algorithm string // gzip, pgzip, zstd, xz or none
+	Level     *int   // the codec's default level if unset, 0 is a level of its own
+}
+
+type Encryption struct {
+	Recipients []string // age X25519 (age1...) or SSH public keys
+	PGPKeys    []string // paths of armored OpenPGP public keys
+}
+
+type Streaming struct {
+	BufferSize   int64  // MB of the dump buffered for each target, 64 if 0
+	StallTimeout int    // seconds a target's buffer may stay full before the target is detached, 300 if 0
+	SpoolDir     string // write streamed dumps here, targets read from the spool and failed ones are retried from it
+}
+
+type Resume struct {
+	StateDir        string // upload progress is kept here so interrupted uploads continue where they stopped, off if empty
+	AbortStaleAfter int    // hours after which unfinished S3 multipart uploads are aborted, 24 if 0, -1 never
+}
+
+type Checksum struct {
+	VerifyUpload   bool   // read uploads back and hash them, S3 uploads sent in one part are always checked against S3's checksum
+	ScrubEveryCron string // re-hash stored backups on this schedule, see the scrub command
+}
+
+type PostgreSQL struct {
+	Mode            string // logical (pg_dump, default) or physical (pg_basebackup of the whole cluster)
+	Checkpoint      string // fast or spread (default), pg_basebackup's checkpoint mode
+	Globals         bool   // dump roles, tablespaces and their grants with pg_dumpall --globals-only as pg_globals
+	NoRolePasswords bool   // leave role passwords out of the globals, for servers that don't let them be read
+	Format          string // custom (pg_dump -Fc, default) or directory (pg_dump -Fd, dumped in parallel and tarred)
+	Jobs            int    // parallel pg_dump jobs for the directory format, 4 if 0
+	PerDatabase     []PostgreSQLDatabase
+}
+
+// PostgreSQLDatabase overrides the format and jobs for one database
+type PostgreSQLDatabase struct {
+	Name   string
+	Format string
+	Jobs   int
+}
+
+type ObjectTags struct {
+	Enabled bool              // tag S3 objects, metadata is always set
+	Keys    map[string]string // engine, database, host, tier, codec, encrypted, sha256, version -> tag key
 }
 
 type Rotation struct {
@@ -183,8 +313,38 @@ func ParseParams(configFile *string) {
 
 	decodeB64Vars()
 
+	if Parameters.ArchivePass != "" && (len(Parameters.Encryption.Recipients) > 0 || len(Parameters.Encryption.PGPKeys) > 0) {
+		log.Fatalf("archivePass can't be used together with encryption.recipients or encryption.pgpKeys\n")
+		return
+	}
+	if len(Parameters.Encryption.Recipients) > 0 && len(Parameters.Encryption.PGPKeys) > 0 {
+		log.Fatalf("encryption.recipients and encryption.pgpKeys can't be used together\n")
+		return
+	}
+
+	if Parameters.Compression.Algorithm == "" {
+		switch {
+		case Parameters.Format == "7zip":
+			Parameters.Compression.Algorithm = "xz"
+		case Parameters.Database == "" || Parameters.Database == "postgresql":
+			// pg_dump -Fc already compresses with the same algorithm as gzip
+			Parameters.Compression.Algorithm = "none"
+		default:
+			Parameters.Compression.Algorithm = "gzip"
+		}
+	}
+
 	if Parameters.PartSize == 0 {
 		Parameters.PartSize = 64
 	}
+	if Parameters.Resume.AbortStaleAfter == 0 {
+		Parameters.Resume.AbortStaleAfter = 24
+	}
+	if Parameters.Streaming.BufferSize == 0 {
+		Parameters.Streaming.BufferSize = 64
+	}
+	if Parameters.Streaming.StallTimeout == 0 {
+		Parameters.Streaming.StallTimeout = 300
+	}
 	Parameters.Fqdn, _ = os.Hostname()
 }
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"monodb-backup/backup"
 	"monodb-backup/clog"
 	"monodb-backup/config"
 	"monodb-backup/notify"
+	"os"
 	"runtime"
 	"time"
 
@@ -32,9 +34,34 @@ func main() {
 
 	config.ParseParams(filePath)
 	clog.InitializeLogger()
+	backup.Version = Version
 
 	var logger *clog.CustomLogger = &clog.Logger
 
+	switch flag.Arg(0) {
+	case "":
+	case "restore":
+		restore(flag.Args()[1:], *filePath)
+		return
+	case "scrub":
+		backup.Scrub()
+		return
+	case "list":
+		list(flag.Args()[1:])
+		return
+	case "pin", "unpin":
+		pin(flag.Arg(0) == "pin", flag.Args()[1:])
+		return
+	case "archive-wal":
+		archiveWAL(flag.Args()[1:])
+		return
+	case "restore-wal":
+		restoreWAL(flag.Args()[1:])
+		return
+	default:
+		logger.Fatal("Unknown command " + flag.Arg(0) + ", should be restore, scrub, list, pin, unpin, archive-wal, restore-wal or empty to take backups")
+	}
+
 	if config.Parameters.Database == "mssql" {
 		backup.InitializeMSSQL()
 	}
@@ -56,6 +83,9 @@ func main() {
 	if config.Parameters.RunEveryCron != "" {
 		c := cron.New()
 		c.AddFunc(config.Parameters.RunEveryCron, initBackup)
+		if config.Parameters.Checksum.ScrubEveryCron != "" {
+			c.AddFunc(config.Parameters.Checksum.ScrubEveryCron, backup.Scrub)
+		}
 		c.Start()
 		select {}
 	} else {
@@ -67,9 +97,7 @@ func main() {
 }
 
 func initBackup() {
-	if config.Parameters.BackupType.Type == "minio" || config.Parameters.BackupType.Type == "s3" {
-		backup.InitializeS3Session()
-	}
+	initBackupType()
 	backup.Backup()
 	if len(notify.FailedDBList) > 0 && config.Parameters.Retry {
 		backup.Retrying = true
@@ -77,3 +105,96 @@ func initBackup() {
 	}
 	notify.SendSingleEntityAlarm()
 }
+
+func initBackupType() {
+	if config.Parameters.BackupType.Type == "minio" || config.Parameters.BackupType.Type == "s3" {
+		backup.InitializeS3Session()
+	}
+	if config.Parameters.BackupType.Type == "azure" {
+		backup.InitializeAzure()
+	}
+	if config.Parameters.BackupType.Type == "gcs" {
+		backup.InitializeGCS()
+	}
+	if config.Parameters.BackupType.Type == "webdav" {
+		backup.InitializeWebDAV()
+	}
+}
+
+func restore(args []string, configFile string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	var opts backup.RestoreOptions
+	fs.StringVar(&opts.Input, "in", "", "Backup file to restore")
+	fs.StringVar(&opts.Output, "out", "", "Only decrypt and decompress the backup into this file")
+	fs.StringVar(&opts.Database, "db", "", "Database to restore into")
+	fs.StringVar(&opts.Globals, "globals", "", "PostgreSQL globals backup (pg_globals-*.sql) to apply before restoring the database, so that its owners exist")
+	fs.IntVar(&opts.Jobs, "jobs", 1, "Parallel pg_restore jobs for PostgreSQL dumps")
+	fs.StringVar(&opts.DataDir, "datadir", "", "Empty data directory to restore a PostgreSQL base backup (pg_basebackup-*.tar) into")
+	fs.StringVar(&opts.TargetTime, "target-time", "", "Recover a PostgreSQL base backup with the archived WAL up to this time (2006-01-02 15:04:05+00), latest replays all of it")
+	fs.StringVar(&opts.Identity, "identity", "", "age identity, SSH private key or armored OpenPGP private key to decrypt the backup with")
+	fs.Parse(args)
+	if opts.Input == "" {
+		fs.Usage()
+		return
+	}
+	opts.Config = configFile
+	if err := backup.Restore(opts); err != nil {
+		clog.Logger.Fatal(err.Error())
+	}
+}
+
+func list(args []string) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	database := fs.String("db", "", "Only list the backups of this database")
+	fs.Parse(args)
+	backup.List(*database)
+}
+
+func pin(pinned bool, args []string) {
+	fs := flag.NewFlagSet("pin", flag.ExitOnError)
+	key := fs.String("key", "", "Key of the backup in the bucket, as printed by list")
+	fs.Parse(args)
+	if *key == "" {
+		fs.Usage()
+		return
+	}
+	if err := backup.Pin(*key, pinned); err != nil {
+		clog.Logger.Fatal(err.Error())
+	}
+}
+
+// archiveWAL is PostgreSQL's archive_command:
+// monodb-backup -config <file> archive-wal %p %f
+func archiveWAL(args []string) {
+	if len(args) != 2 {
+		clog.Logger.Fatal("Usage: monodb-backup archive-wal <wal path> <wal file name>")
+	}
+	initBackupType()
+	if err := backup.ArchiveWAL(args[0], args[1]); err != nil {
+		clog.Logger.Fatal("Couldn't archive " + args[1] + " - Error: " + err.Error())
+	}
+}
+
+// restoreWAL is PostgreSQL's restore_command:
+// monodb-backup -config <file> restore-wal %f %p
+func restoreWAL(args []string) {
+	fs := flag.NewFlagSet("restore-wal", flag.ExitOnError)
+	identity := fs.String("identity", "", "age identity, SSH private key or armored OpenPGP private key to decrypt the WAL with")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		clog.Logger.Fatal("Usage: monodb-backup restore-wal [-identity key] <wal file name> <destination path>")
+	}
+	initBackupType()
+	err := backup.RestoreWAL(fs.Arg(0), fs.Arg(1), *identity)
+	if errors.Is(err, backup.ErrWALNotFound) {
+		// PostgreSQL asks for files past the end of the archive
+		clog.Logger.Info(fs.Arg(0) + " is not in the WAL archive")
+		os.Exit(1)
+	}
+	if err != nil {
+		// an exit status above 125 stops the recovery instead of taking the
+		// file for missing and ending it early
+		clog.Logger.Error("Couldn't restore " + fs.Arg(0) + " - Error: " + err.Error())
+		os.Exit(255)
+	}
+}